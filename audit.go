@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// a record of a request for report data, whether it was allowed or not
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Key      string    `json:"key"`
+	AppName  string    `json:"appName"`
+	ClientIP string    `json:"clientIP"`
+	Path     string    `json:"path"`
+	// prompt names to hashes of the answers (see hashPromptAnswers)
+	PromptAnswers map[string]string `json:"promptAnswers,omitempty"`
+	Status        int               `json:"status"`
+	// -1 if no data was sent
+	Rows        int    `json:"rows"`
+	CacheStatus string `json:"cacheStatus,omitempty"`
+}
+
+func createAuditTable(db *sql.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS auditLog (
+			time INTEGER NOT NULL,
+			key TEXT NOT NULL,
+			appName TEXT NOT NULL,
+			clientIP TEXT NOT NULL,
+			path TEXT NOT NULL,
+			promptAnswers TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			rows INTEGER NOT NULL,
+			cacheStatus TEXT NOT NULL
+		)
+	`)
+	jgh.PanicOnErr(err)
+	_, err = db.Exec(
+		"CREATE INDEX IF NOT EXISTS auditLogTime ON auditLog (time)",
+	)
+	jgh.PanicOnErr(err)
+	_, err = db.Exec(
+		"CREATE INDEX IF NOT EXISTS auditLogPath ON auditLog (path)",
+	)
+	jgh.PanicOnErr(err)
+}
+
+// prompt answers can be personal information (ex: a student ID), and are
+// often easy to guess, so we only keep an HMAC of each answer with a key
+// that is not in usage.sqlite3. To check if a request used a given answer,
+// search for it with the "answer" filter.
+func hashPromptAnswers(promptAnswers map[string]string) map[string]string {
+	if len(promptAnswers) == 0 {
+		return nil
+	}
+	key := auditKey()
+	hashed := make(map[string]string)
+	for name, answer := range promptAnswers {
+		hashed[name] = hashPromptAnswer(key, answer)
+	}
+	return hashed
+}
+
+func hashPromptAnswer(key []byte, answer string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(answer))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// the key for hashing prompt answers is kept in audit.key next to
+// config.json. It is made the first time we need it.
+const auditKeyFile = "audit.key"
+
+var auditKeyCache struct {
+	sync.Mutex
+	key []byte
+}
+
+func auditKey() []byte {
+	auditKeyCache.Lock()
+	defer auditKeyCache.Unlock()
+	if auditKeyCache.key != nil {
+		return auditKeyCache.key
+	}
+
+	keyPath := filepath.Join(filepath.Dir(configFixedLocation()), auditKeyFile)
+	encodedKey, err := ioutil.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		_, err = rand.Read(key)
+		jgh.PanicOnErr(err)
+		// another process may have made one first, so only create the
+		// file if it isn't there
+		file, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+			jgh.PanicOnErr(err)
+			err = file.Close()
+			jgh.PanicOnErr(err)
+			auditKeyCache.key = key
+			return key
+		}
+		if !errors.Is(err, os.ErrExist) {
+			jgh.PanicOnErr(err)
+		}
+		encodedKey, err = ioutil.ReadFile(keyPath)
+	}
+	jgh.PanicOnErr(err)
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedKey)))
+	if err != nil || len(key) != 32 {
+		panic(keyPath + " must be 32 bytes of base64")
+	}
+	auditKeyCache.key = key
+	return key
+}
+
+// count the data rows (not including the header) in CSV data
+func countRows(reportCSV string) int {
+	csvReader := csv.NewReader(strings.NewReader(reportCSV))
+	csvReader.ReuseRecord = true
+	rows := -1
+	for {
+		_, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		jgh.PanicOnErr(err)
+		rows++
+	}
+	if rows < 0 {
+		return 0
+	}
+	return rows
+}
+
+// add an entry to the audit log and remove entries older than
+// auditRetentionDays. This is called after the response is sent, so if
+// this fails we can only log it.
+func recordAccess(entry auditEntry) {
+	config.mutex.Lock()
+	retentionDays := config.AuditRetentionDays
+	config.mutex.Unlock()
+
+	success, errorMessage := jgh.Try(0, 1, false, "", func() bool {
+		answersJSON := jsonColumn(entry.PromptAnswers)
+		withDatabase(func(db *sql.DB) {
+			createAuditTable(db)
+
+			_, err := db.Exec(`
+				INSERT INTO auditLog
+					(time, key, appName, clientIP, path, promptAnswers,
+						status, rows, cacheStatus)
+				VALUES
+					(?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`,
+				entry.Time.Unix(),
+				entry.Key,
+				entry.AppName,
+				entry.ClientIP,
+				entry.Path,
+				answersJSON,
+				entry.Status,
+				entry.Rows,
+				entry.CacheStatus,
+			)
+			jgh.PanicOnErr(err)
+
+			if retentionDays > 0 {
+				oldest := entry.Time.AddDate(0, 0, -int(retentionDays))
+				_, err = db.Exec(
+					"DELETE FROM auditLog WHERE time < ?",
+					oldest.Unix(),
+				)
+				jgh.PanicOnErr(err)
+			}
+		})
+		return true
+	})
+	if !success {
+		log.Println("Failed to write to the audit log:", errorMessage)
+	}
+}
+
+// search the audit log, newest first. filters can have
+//   - key: the start of the key (ex: a report password ID)
+//   - app: the app name
+//   - ip: the client IP
+//   - path: a report path, or a folder ending in "/*"
+//   - answer: a prompt answer, for any prompt
+//   - since and until: a date (2006-01-02) or an RFC 3339 time
+//   - denied: "true" for only denied requests
+//   - limit: the most entries to return (default 1000)
+func searchAuditLog(filters map[string]string) (entries []auditEntry) {
+	where := []string{"1"}
+	var args []interface{}
+	if key := filters["key"]; key != "" {
+		where = append(where, "key LIKE ? || '%' ESCAPE '\\'")
+		args = append(args, escapeLike(key))
+	}
+	if app := filters["app"]; app != "" {
+		where = append(where, "appName = ?")
+		args = append(args, app)
+	}
+	if ip := filters["ip"]; ip != "" {
+		where = append(where, "clientIP = ?")
+		args = append(args, ip)
+	}
+	if path := filters["path"]; strings.HasSuffix(path, "/*") {
+		where = append(where, "path LIKE ? || '%' ESCAPE '\\'")
+		args = append(args, escapeLike(strings.TrimSuffix(path, "*")))
+	} else if path != "" {
+		where = append(where, "path = ?")
+		args = append(args, path)
+	}
+	if answer := filters["answer"]; answer != "" {
+		// hashes are hex, so they can't contain anything LIKE treats
+		// specially
+		where = append(where, "promptAnswers LIKE ?")
+		args = append(args, `%"`+hashPromptAnswer(auditKey(), answer)+`"%`)
+	}
+	if since := filters["since"]; since != "" {
+		where = append(where, "time >= ?")
+		args = append(args, parseDateOrTime("since", since).Unix())
+	}
+	if until := filters["until"]; until != "" {
+		where = append(where, "time < ?")
+		args = append(args, parseDateOrTime("until", until).Unix())
+	}
+	if filters["denied"] == "true" {
+		where = append(where, "status >= 400")
+	}
+	limit := uint64(1000)
+	if limitString := filters["limit"]; limitString != "" {
+		var err error
+		limit, err = strconv.ParseUint(limitString, 10, 32)
+		if err != nil {
+			panic("400 limit must be a number")
+		}
+	}
+	args = append(args, limit)
+
+	entries = []auditEntry{}
+	withDatabase(func(db *sql.DB) {
+		createAuditTable(db)
+
+		rows, err := db.Query(`
+			SELECT time, key, appName, clientIP, path, promptAnswers,
+				status, rows, cacheStatus
+			FROM auditLog
+			WHERE `+strings.Join(where, " AND ")+`
+			ORDER BY time DESC, rowid DESC
+			LIMIT ?
+		`, args...)
+		jgh.PanicOnErr(err)
+		defer rows.Close()
+
+		entries = entries[:0]
+		for rows.Next() {
+			var entry auditEntry
+			var unixTime int64
+			var answersJSON string
+			err = rows.Scan(
+				&unixTime,
+				&entry.Key,
+				&entry.AppName,
+				&entry.ClientIP,
+				&entry.Path,
+				&answersJSON,
+				&entry.Status,
+				&entry.Rows,
+				&entry.CacheStatus,
+			)
+			jgh.PanicOnErr(err)
+			entry.Time = time.Unix(unixTime, 0)
+			if answersJSON != "" {
+				err = json.Unmarshal([]byte(answersJSON), &entry.PromptAnswers)
+				jgh.PanicOnErr(err)
+			}
+			entries = append(entries, entry)
+		}
+		jgh.PanicOnErr(rows.Err())
+	})
+	return
+}
+
+// escape % and _ so a value can be used as a LIKE prefix
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "%", `\%`)
+	return strings.ReplaceAll(s, "_", `\_`)
+}
+
+// GET /audit searches the audit log. This requires the master password.
+// Filters are sent as query parameters (see searchAuditLog).
+func handleAuditRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	providedPassword string,
+) {
+	if !isMasterPassword(providedPassword) {
+		response.Header().Set("WWW-Authenticate", `Basic realm="Carl Sagan"`)
+		response.Header().Set("Content-Type", "text/plain")
+		response.WriteHeader(401)
+		_, err := response.Write([]byte("Unauthorised: Searching the audit " +
+			"log requires the master password\n"))
+		jgh.PanicOnErr(err)
+		return
+	}
+	if request.Method != "GET" {
+		response.Header().Set("Content-Type", "text/plain")
+		response.WriteHeader(405)
+		_, err := response.Write([]byte("Use GET /audit\n"))
+		jgh.PanicOnErr(err)
+		return
+	}
+
+	entries := searchAuditLog(getFormValues(request))
+	entriesJSON, err := json.MarshalIndent(entries, "", "\t")
+	jgh.PanicOnErr(err)
+	response.Header().Set("Content-Type", "application/json")
+	_, err = response.Write(entriesJSON)
+	jgh.PanicOnErr(err)
+}
+
+// records the status code sent, for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = 200
+	}
+	return recorder.ResponseWriter.Write(data)
+}
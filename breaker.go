@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// if the circuit breaker is open for this long we let 1 request through to
+// see if Cognos is back
+const defaultBreakerOpenFor = 300
+
+// a time of day when Cognos is expected to be down. Times are "15:04" in
+// local time. If End is before Start the window goes past midnight.
+type maintenanceWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// parse the start and end of a window as a duration after midnight
+func (w maintenanceWindow) parse() (start, end time.Duration) {
+	startTime, err := time.Parse("15:04", w.Start)
+	jgh.PanicOnErr(err)
+	endTime, err := time.Parse("15:04", w.End)
+	jgh.PanicOnErr(err)
+
+	// time.Parse gives us a time on Jan 1st of year 0
+	midnight := time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)
+	return startTime.Sub(midnight), endTime.Sub(midnight)
+}
+
+// if now is in a maintenance window, return when it started
+func inMaintenanceWindow(now time.Time, windows []maintenanceWindow) (
+	inWindow bool,
+	windowStart time.Time,
+) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, window := range windows {
+		start, end := window.parse()
+		length := end - start
+		if length <= 0 {
+			length += 24 * time.Hour
+		}
+
+		// a window that goes past midnight may have started yesterday
+		for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+			windowStart = day.Add(start)
+			if !now.Before(windowStart) && now.Before(windowStart.Add(length)) {
+				return true, windowStart
+			}
+		}
+	}
+	return false, time.Time{}
+}
+
+// the state of the circuit breakers is kept in the database so it is shared
+// between CGI processes. Each environment has it's own circuit breaker.
+func createBreakerTable(db *sql.DB, envName string) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS circuitBreakers (
+			environment TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL,
+			openedAt INTEGER NOT NULL,
+			lastSuccess INTEGER NOT NULL
+		)
+	`)
+	jgh.PanicOnErr(err)
+	_, err = db.Exec(`
+		INSERT OR IGNORE INTO circuitBreakers
+			(environment, failures, openedAt, lastSuccess)
+		VALUES
+			(?, 0, 0, 0)
+	`, envName)
+	jgh.PanicOnErr(err)
+}
+
+// check if we should try to talk to Cognos. If the circuit breaker has been
+// open for a while, this lets 1 request through to see if Cognos is back.
+func cognosAvailable(envName string) (available bool) {
+	config.mutex.Lock()
+	threshold := config.BreakerThreshold
+	openFor := int64(config.BreakerOpenFor)
+	env, _ := getEnvironment(envName)
+	config.mutex.Unlock()
+	if openFor == 0 {
+		openFor = defaultBreakerOpenFor
+	}
+
+	now := time.Now()
+	withDatabase(func(db *sql.DB) {
+		createBreakerTable(db, envName)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		var failures int
+		var openedAt, lastSuccess int64
+		row := tx.QueryRow(`
+			SELECT failures, openedAt, lastSuccess
+			FROM circuitBreakers
+			WHERE environment = ?
+		`, envName)
+		err = row.Scan(&failures, &openedAt, &lastSuccess)
+		jgh.PanicOnErr(err)
+
+		// breakerThreshold defaults to 0, which turns the breaker off. It
+		// only helps if keepStale (also 0 by default) leaves stale items
+		// in the cache for us to serve.
+		open := threshold > 0 && failures >= threshold
+		// during maintenance the breaker starts out open, as if it had
+		// been opened when the window started
+		inWindow, windowStart := inMaintenanceWindow(now, env.MaintenanceWindows)
+		if inWindow && lastSuccess < windowStart.Unix() {
+			open = true
+			if openedAt < windowStart.Unix() {
+				openedAt = windowStart.Unix()
+			}
+		}
+
+		if !open {
+			available = true
+			return
+		}
+		if now.Unix()-openedAt < openFor {
+			available = false
+			return
+		}
+
+		// it has been a while. Let this request through, but make
+		// everyone else wait another openFor seconds.
+		_, err = tx.Exec(
+			"UPDATE circuitBreakers SET openedAt = ? WHERE environment = ?",
+			now.Unix(),
+			envName,
+		)
+		jgh.PanicOnErr(err)
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+		available = true
+	})
+	return
+}
+
+// close the circuit breaker
+func recordCognosSuccess(envName string) {
+	withDatabase(func(db *sql.DB) {
+		createBreakerTable(db, envName)
+
+		_, err := db.Exec(`
+			UPDATE circuitBreakers
+			SET failures = 0, lastSuccess = ?
+			WHERE environment = ?
+		`, time.Now().Unix(), envName)
+		jgh.PanicOnErr(err)
+	})
+}
+
+// count a failure. This opens the circuit breaker if there have been too
+// many failures in a row.
+func recordCognosFailure(envName string) {
+	config.mutex.Lock()
+	threshold := config.BreakerThreshold
+	config.mutex.Unlock()
+
+	withDatabase(func(db *sql.DB) {
+		createBreakerTable(db, envName)
+
+		_, err := db.Exec(`
+			UPDATE circuitBreakers SET
+				failures = failures + 1,
+				openedAt = CASE
+					WHEN failures + 1 = ? THEN ?
+					ELSE openedAt
+				END
+			WHERE environment = ?
+		`, threshold, time.Now().Unix(), envName)
+		jgh.PanicOnErr(err)
+	})
+}
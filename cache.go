@@ -18,6 +18,15 @@ import (
 	"github.com/natefinch/atomic"
 )
 
+// where the data in a response came from. This is what we send in the
+// X-Cache header.
+const (
+	cacheHit  = "HIT"
+	cacheMiss = "MISS"
+	// served from the cache because we could not run the report
+	cacheStale = "STALE"
+)
+
 type reportIdentifier struct {
 	Path          []string
 	PromptAnswers map[string]string
@@ -57,6 +66,41 @@ func getUsageFile() string {
 	return usageFile
 }
 
+// open the sqlite database and pass it to f. This is tried 3 times in case
+// we get "file in use". If all 3 tries fail we panic.
+func withDatabase(f func(db *sql.DB)) {
+	usageFile := getUsageFile()
+	jgh.Try(1, 3, true, "", func() bool {
+		db, err := sql.Open("sqlite3", usageFile)
+		jgh.PanicOnErr(err)
+		defer db.Close()
+
+		f(db)
+		return true
+	})
+}
+
+// add a column to a table that was created by an older version. definition
+// is everything after the column name (ex: "INTEGER NOT NULL DEFAULT 0").
+func addColumn(db *sql.DB, table string, column string, definition string) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	jgh.PanicOnErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		jgh.PanicOnErr(err)
+		if name == column {
+			return
+		}
+	}
+	jgh.PanicOnErr(rows.Err())
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	jgh.PanicOnErr(err)
+}
+
 func recordUse(path []string, promptAnswers map[string]string) {
 	usageFile := getUsageFile()
 	hash := pathHash(path, promptAnswers)
@@ -165,7 +209,10 @@ func warmCache(usedWithin uint) {
 		success, msg := jgh.Try(0, 1, false, "", func() bool {
 			// we warm the cache by just running through the normal steps to
 			// prepare a response, but we specify that the data must be new
-			PrepareResponse(false, report.Path, report.PromptAnswers, 0)
+			PrepareResponse(report.Path, report.PromptAnswers, cacheOptions{
+				MaxAge:       0,
+				StaleIfError: -1,
+			})
 			return true
 		})
 		if !success && !runningAsCGI {
@@ -185,14 +232,16 @@ func pathHash(path []string, promptAnswers map[string]string) string {
 	return fmt.Sprintf("%016X", hash)
 }
 
-// deletes files older than config.MaxAge from the cache
+// deletes files older than maxAge + config.KeepStale from the cache. We
+// don't know which environment a cache item is from, so we use the longest
+// maxAge of any environment.
 func cleanCache() {
 	cacheDir := getCacheDir()
 	cacheItems, err := ioutil.ReadDir(cacheDir)
 	jgh.PanicOnErr(err)
 
 	config.mutex.Lock()
-	maxAge := time.Duration(config.MaxAge) * time.Second
+	maxAge := time.Duration(longestMaxAge()+config.KeepStale) * time.Second
 	config.mutex.Unlock()
 
 	// BUG(jon): there is a race condition here. We could identify an old
@@ -209,16 +258,22 @@ func cleanCache() {
 	return
 }
 
-func addToCache(hash string, data string) {
+// add an item to the cache and report when it was added
+func addToCache(hash string, data string) (generated time.Time) {
 	file := filepath.Join(getCacheDir(), hash)
 	// atomically write data to file
 	err := atomic.WriteFile(file, strings.NewReader(data))
 	jgh.PanicOnErr(err)
+
+	// use the modified time from the file so we agree with getFromCache
+	fileInfo, err := os.Stat(file)
+	jgh.PanicOnErr(err)
+	return fileInfo.ModTime()
 }
 
-// get an item form the cache. Aditionally report it's age in seconds or -1
-// if the item was not in the cache
-func getFromCache(hash string) (data string, age int) {
+// get an item form the cache. Aditionally report when it was generated and
+// it's age in seconds or -1 if the item was not in the cache
+func getFromCache(hash string) (data string, generated time.Time, age int) {
 	file := filepath.Join(getCacheDir(), hash)
 
 	// get file modified time
@@ -226,9 +281,10 @@ func getFromCache(hash string) (data string, age int) {
 	// if we get a "file does not exist" error, report that
 	// the item is not in the cache
 	if errors.Is(err, os.ErrNotExist) {
-		return "", -1
+		return "", time.Time{}, -1
 	}
-	age = int(time.Now().Sub(fileInfo.ModTime()) / time.Second)
+	generated = fileInfo.ModTime()
+	age = int(time.Now().Sub(generated) / time.Second)
 
 	// try to read the file
 	dataBytes, err := ioutil.ReadFile(file)
@@ -236,9 +292,9 @@ func getFromCache(hash string) (data string, age int) {
 	// in the cache. This is unlikely (we already checked), but could happen
 	// if the file is deleted between the first check and the file read.
 	if errors.Is(err, os.ErrNotExist) {
-		return "", -1
+		return "", time.Time{}, -1
 	}
 	jgh.PanicOnErr(err)
 
-	return string(dataBytes), age
+	return string(dataBytes), generated, age
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// how a request is allowed to use the cache. All values are in seconds.
+type cacheOptions struct {
+	// the oldest cache item we can serve without running the report
+	MaxAge int
+	// if a cache item is older than MaxAge, but not older than
+	// MaxAge + StaleWhileRevalidate, we serve it and refresh it in the
+	// background
+	StaleWhileRevalidate int
+	// the oldest cache item we can serve if running the report fails.
+	// -1 means we never do this.
+	StaleIfError int
+	// never run the report. Only serve from the cache.
+	OnlyIfCached bool
+	// don't save the result in the cache
+	NoStore bool
+}
+
+// parse a Cache-Control request header as described in RFC 9111. freshFor
+// is how long a cache item is fresh for (config.MaxAge).
+// staleWhileRevalidate comes from the config and is only used if the client
+// did not say anything about how old of data it wants.
+func parseCacheControl(
+	header string,
+	freshFor uint,
+	staleWhileRevalidate uint,
+) (opts cacheOptions, err error) {
+	opts.MaxAge = int(freshFor)
+	opts.StaleIfError = -1
+
+	var maxAge, minFresh, maxStale, staleIfError int
+	var hasMaxAge, hasMinFresh, hasMaxStale, hasStaleIfError, noCache bool
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+
+		// split "name=value". value is optional for some directives and
+		// may be quoted.
+		name := directive
+		value := ""
+		if pos := strings.Index(directive, "="); pos != -1 {
+			name = directive[:pos]
+			value = strings.Trim(directive[pos+1:], `"`)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		// parse the number of seconds for directives that have one. If
+		// the value is optional and missing, seconds is math.MaxInt32
+		seconds := math.MaxInt32
+		switch name {
+		case "max-age", "min-fresh", "max-stale", "stale-if-error":
+			if value != "" {
+				seconds64, parseErr := strconv.ParseUint(value, 10, 31)
+				if parseErr != nil {
+					return opts, errors.New(name + " must be a number of seconds")
+				}
+				seconds = int(seconds64)
+			} else if name == "max-age" || name == "min-fresh" {
+				return opts, errors.New(name + " requires a value")
+			}
+		}
+
+		switch name {
+		case "max-age":
+			maxAge, hasMaxAge = seconds, true
+		case "min-fresh":
+			minFresh, hasMinFresh = seconds, true
+		case "max-stale":
+			maxStale, hasMaxStale = seconds, true
+		case "stale-if-error":
+			staleIfError, hasStaleIfError = seconds, true
+		case "no-cache":
+			noCache = true
+		case "no-store":
+			opts.NoStore = true
+		case "only-if-cached":
+			opts.OnlyIfCached = true
+		}
+		// unknown directives are ignored, as required by the RFC
+	}
+
+	// on its own, max-age replaces our freshness lifetime for this
+	// request. Clients have always been able to use this to accept older
+	// data than config.MaxAge, so it can make the lifetime longer as well
+	// as shorter.
+	if hasMaxAge && !hasMaxStale {
+		opts.MaxAge = maxAge
+	}
+	// max-stale lets us go past the freshness lifetime
+	if hasMaxStale {
+		opts.MaxAge = addSeconds(opts.MaxAge, maxStale)
+	}
+	// min-fresh requires that the item stay fresh for a while longer
+	if hasMinFresh {
+		opts.MaxAge -= minFresh
+		if opts.MaxAge < 0 {
+			opts.MaxAge = 0
+		}
+	}
+	// max-age is still a limit on age when combined with max-stale
+	// (RFC 9111 section 5.2.1.1)
+	if hasMaxAge && opts.MaxAge > maxAge {
+		opts.MaxAge = maxAge
+	}
+	if noCache {
+		opts.MaxAge = 0
+	}
+
+	// a plain only-if-cached means any cache item is fine. This is how
+	// it has always worked here.
+	clientSetAge := hasMaxAge || hasMinFresh || hasMaxStale || noCache
+	if opts.OnlyIfCached && !clientSetAge {
+		opts.MaxAge = math.MaxInt32
+	}
+
+	// we only serve stale data on our own if the client did not ask for
+	// something specific
+	if !clientSetAge {
+		opts.StaleWhileRevalidate = int(staleWhileRevalidate)
+	}
+
+	if hasStaleIfError {
+		opts.StaleIfError = addSeconds(int(freshFor), staleIfError)
+	}
+
+	return opts, nil
+}
+
+// add 2 numbers of seconds where math.MaxInt32 means "forever"
+func addSeconds(a, b int) int {
+	if a >= math.MaxInt32-b {
+		return math.MaxInt32
+	}
+	return a + b
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	// freshFor is 300 and staleWhileRevalidate is 30 for every test
+	tests := []struct {
+		header string
+		want   cacheOptions
+	}{
+		{"", cacheOptions{MaxAge: 300, StaleWhileRevalidate: 30, StaleIfError: -1}},
+		{"max-age=60", cacheOptions{MaxAge: 60, StaleIfError: -1}},
+		{"max-age=86400", cacheOptions{MaxAge: 86400, StaleIfError: -1}},
+		{"max-stale=100", cacheOptions{MaxAge: 400, StaleIfError: -1}},
+		{"max-stale", cacheOptions{MaxAge: math.MaxInt32, StaleIfError: -1}},
+		{"max-age=60, max-stale", cacheOptions{MaxAge: 60, StaleIfError: -1}},
+		{"max-age=1000, max-stale=100", cacheOptions{MaxAge: 400, StaleIfError: -1}},
+		{"min-fresh=100", cacheOptions{MaxAge: 200, StaleIfError: -1}},
+		{"min-fresh=1000", cacheOptions{MaxAge: 0, StaleIfError: -1}},
+		{"no-cache", cacheOptions{MaxAge: 0, StaleIfError: -1}},
+		{"only-if-cached", cacheOptions{MaxAge: math.MaxInt32, StaleWhileRevalidate: 30, StaleIfError: -1, OnlyIfCached: true}},
+		{"only-if-cached, max-age=60", cacheOptions{MaxAge: 60, StaleIfError: -1, OnlyIfCached: true}},
+		{"stale-if-error=600", cacheOptions{MaxAge: 300, StaleWhileRevalidate: 30, StaleIfError: 900}},
+		{"no-store", cacheOptions{MaxAge: 300, StaleWhileRevalidate: 30, StaleIfError: -1, NoStore: true}},
+		{`MAX-AGE="60", unknown`, cacheOptions{MaxAge: 60, StaleIfError: -1}},
+	}
+	for _, test := range tests {
+		got, err := parseCacheControl(test.header, 300, 30)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.header, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.header, got, test.want)
+		}
+	}
+
+	for _, header := range []string{"max-age", "max-age=-1", "min-fresh", "max-stale=abc"} {
+		_, err := parseCacheControl(header, 300, 30)
+		if err == nil {
+			t.Errorf("%q: expected an error", header)
+		}
+	}
+}
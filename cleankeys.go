@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/9072997/jgh"
+)
+
+// a scope has to name a namespace, a DSN, a root folder ("public" or a
+// user), and at least 1 thing in it for us to check it. Scopes that cover
+// more than that (ex: "esp/bentonvisms/*" or "*") can't be checked.
+const minCheckableScopeLength = 4
+
+// check if the report or folder a scope points to still exists in Cognos.
+// checkable is false if the scope is too broad to check.
+func scopeExists(scope string) (exists bool, checkable bool) {
+	folder := strings.HasSuffix(scope, "/*")
+	path := ParsePath(strings.TrimSuffix(scope, "/*"))
+
+	config.mutex.Lock()
+	_, reportPath := splitEnvironment(path)
+	config.mutex.Unlock()
+	if len(reportPath) < minCheckableScopeLength {
+		return false, false
+	}
+	for _, component := range reportPath {
+		if component == "*" {
+			return false, false
+		}
+	}
+
+	cognosInstance, cognosPath, done := openCognos(path)
+	defer done()
+	return cognosInstance.PathExists(cognosPath, folder), true
+}
+
+// remove 1 scope from a password. If that was the password's last scope,
+// the password is removed too.
+func removePasswordScope(id string, scope string) {
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		_, err = tx.Exec(
+			"DELETE FROM passwordScopes WHERE id = ? AND scope = ?",
+			id,
+			scope,
+		)
+		jgh.PanicOnErr(err)
+		_, err = tx.Exec(`
+			DELETE FROM passwords
+			WHERE id = ? AND NOT EXISTS (
+				SELECT 1 FROM passwordScopes WHERE passwordScopes.id = passwords.id
+			)
+		`, id)
+		jgh.PanicOnErr(err)
+
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+	})
+}
+
+// used by --clean-keys to find report passwords for reports and folders
+// that no longer exist in Cognos. If remove is true, those scopes are
+// removed, along with passwords that have no scopes left. Scopes we can't
+// check (ex: Cognos is down, or the scope covers a whole DSN) are left
+// alone.
+func cleanReportPasswords(remove bool) {
+	for _, key := range listReportPasswords() {
+		for _, scope := range key.Scopes {
+			var exists, checkable bool
+			success, errorMessage := jgh.Try(0, 1, false, "", func() bool {
+				exists, checkable = scopeExists(scope)
+				return true
+			})
+			if !success {
+				fmt.Printf("%s\t%s\tcould not check: %v\n", key.ID, scope, errorMessage)
+				continue
+			}
+			if !checkable {
+				fmt.Printf("%s\t%s\tnot checked (too broad)\n", key.ID, scope)
+				continue
+			}
+			if exists {
+				continue
+			}
+			if remove {
+				removePasswordScope(key.ID, scope)
+				fmt.Printf("%s\t%s\tremoved\n", key.ID, scope)
+			} else {
+				fmt.Printf("%s\t%s\tmissing\n", key.ID, scope)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parse an IP address or CIDR range. A single address is treated as a
+// range with just that address in it. Returns nil if s is not valid.
+func parseIPRange(s string) *net.IPNet {
+	if strings.Contains(s, "/") {
+		_, ipRange, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil
+		}
+		return ipRange
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// check if an IP address is in any of a list of ranges
+func ipInRanges(s string, ipRanges []string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, ipRange := range ipRanges {
+		parsed := parseIPRange(ipRange)
+		if parsed != nil && parsed.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the IP address a request came from. If the request came through one of
+// our trusted proxies, we use X-Forwarded-For. Proxies add to the end of
+// X-Forwarded-For, so we go from right to left and stop at the first
+// address that isn't a trusted proxy. Anything before that could have
+// been made up by the client.
+func clientIP(request *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		// CGI can give us just the address
+		remoteIP = request.RemoteAddr
+	}
+
+	config.mutex.Lock()
+	trustedProxies := config.TrustedProxies
+	config.mutex.Unlock()
+
+	forwardedFor := request.Header.Values("X-Forwarded-For")
+	hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !ipInRanges(remoteIP, trustedProxies) {
+			break
+		}
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		remoteIP = hop
+	}
+	return remoteIP
+}
@@ -54,6 +54,25 @@ type directoryEntry struct {
 	Name     string `xml:"abstract"`
 }
 
+// HTTPError is what we panic with when Cognos sends back something other
+// than a 200.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e HTTPError) Error() string {
+	return "Error from Cognos: " + e.Status + ":" + e.Body
+}
+
+// LoginRejected is true if Cognos (or the reverse proxy in front of it)
+// did not accept our username and password. Retrying won't help.
+func (e HTTPError) LoginRejected() bool {
+	return e.StatusCode == http.StatusUnauthorized ||
+		e.StatusCode == http.StatusForbidden
+}
+
 // return the JSON payload necessary to set the namespace and DSN
 func makeNamespaceAndDSN(namespace, dsn string) string {
 	var n namespaceAndDSN
@@ -202,6 +221,9 @@ func (c Session) Request(method string, link string, reqBody string) (respBody s
 		tryCount = c.RetryCount + 1
 	}
 
+	// a rejected password is not retried, since it won't start working
+	// and retrying could lock the account
+	var rejected *HTTPError
 	success, _ := jgh.Try(int(c.RetryDelay), tryCount, true, "", func() bool {
 		// make an io.reader if we have post data
 		var reqBodyReader io.Reader
@@ -240,11 +262,19 @@ func (c Session) Request(method string, link string, reqBody string) (respBody s
 
 		// check HTTP response code
 		if resp.StatusCode != 200 {
-			panic("Error from Cognos: " + resp.Status + ":" + respBody)
+			httpErr := HTTPError{resp.StatusCode, resp.Status, respBody}
+			if httpErr.LoginRejected() {
+				rejected = &httpErr
+				return true
+			}
+			panic(httpErr)
 		}
 
 		return true
 	})
+	if rejected != nil {
+		panic(*rejected)
+	}
 	if !success {
 		panic("Cognos request to " + link + " failed.")
 	}
@@ -300,6 +330,36 @@ func (c Session) encodePath(path []string) string {
 	return strings.Join(encodedPath, "/")
 }
 
+// PathExists checks if a report (or a folder if folder is true) exists.
+// It returns false if Cognos says the path was not found. Any other error
+// causes a panic, since we can't tell if the path exists.
+func (c Session) PathExists(path []string, folder bool) bool {
+	link := "/ibmcognos/bi/v1/disp/rds/reportPrompts/path/" + c.encodePath(path)
+	if folder {
+		link = "/ibmcognos/bi/v1/disp/rds/wsil/path/" + c.encodePath(path)
+	}
+
+	err := c.httpLockPool.Acquire(context.Background(), 1)
+	jgh.PanicOnErr(err)
+	defer c.httpLockPool.Release(1)
+
+	req, err := http.NewRequest("GET", c.URL+link, nil)
+	jgh.PanicOnErr(err)
+	req.SetBasicAuth(c.User, c.Pass)
+	resp, err := c.client.Do(req)
+	jgh.PanicOnErr(err)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return true
+	case 404:
+		return false
+	default:
+		panic(HTTPError{resp.StatusCode, resp.Status, jgh.ReadAll(resp.Body)})
+	}
+}
+
 // DownloadReportCSV returns a string containing CSV data for a cognos report.
 // This function triggers the execution of the report, and may take a while
 // to return.
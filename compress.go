@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+
+	"github.com/9072997/jgh"
+	"github.com/klauspost/compress/zstd"
+)
+
+// content codings we support, in the order we prefer them
+var supportedEncodings = []string{"zstd", "gzip"}
+
+// bodies smaller than this are not worth compressing
+const minCompressSize = 1024
+
+// this is safe to share between goroutines as long as we only use EncodeAll
+var zstdEncoder *zstd.Encoder
+
+func init() {
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	jgh.PanicOnErr(err)
+}
+
+// pick a content coding based on an Accept-Encoding header. An empty
+// string means we should not compress the response.
+func negotiateEncoding(acceptEncoding string) (encoding string) {
+	// get the q value for each coding the client mentioned
+	qValues := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+		qValues[coding] = q
+	}
+
+	// use the coding with the highest q value. For a tie, use the one we
+	// prefer.
+	bestQ := 0.0
+	for _, coding := range supportedEncodings {
+		q, mentioned := qValues[coding]
+		if !mentioned {
+			q = qValues["*"]
+		}
+		if q > bestQ {
+			bestQ = q
+			encoding = coding
+		}
+	}
+	return
+}
+
+// compress data using a coding from supportedEncodings
+func compressBody(encoding string, data []byte) []byte {
+	switch encoding {
+	case "zstd":
+		return zstdEncoder.EncodeAll(data, nil)
+	case "gzip":
+		var buf bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buf)
+		_, err := gzipWriter.Write(data)
+		jgh.PanicOnErr(err)
+		err = gzipWriter.Close()
+		jgh.PanicOnErr(err)
+		return buf.Bytes()
+	default:
+		panic("unsupported content coding: " + encoding)
+	}
+}
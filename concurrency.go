@@ -0,0 +1,338 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// a running report updates its heartbeat this often. If it hasn't for
+// staleCognosSession, it has been abandoned (ex: a CGI process was
+// killed).
+const cognosHeartbeat = 10 * time.Second
+const staleCognosSession = time.Minute
+
+// a request waiting for Cognos checks in this often. If it hasn't checked
+// in for staleQueueEntry, it has given up or its process was killed.
+const cognosQueueCheckIn = 10 * time.Second
+const staleQueueEntry = 30 * time.Second
+
+// a request waiting for Cognos looks for a free turn this often at first,
+// then less often the longer it waits. Looking doesn't write to the
+// database, so it doesn't get in the way of other requests.
+const minCognosQueuePoll = 250 * time.Millisecond
+const maxCognosQueuePoll = 2 * time.Second
+
+// the longest a request will wait for a turn to run a report in Cognos
+const maxCognosQueueWait = 5 * time.Minute
+
+// Sessions and the queue are kept in the database so limits are shared
+// between goroutines and CGI processes.
+func createCognosSessionsTable(db *sql.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS cognosSessions (
+			id TEXT PRIMARY KEY,
+			environment TEXT NOT NULL,
+			username TEXT NOT NULL,
+			started INTEGER NOT NULL,
+			heartbeat INTEGER NOT NULL
+		)
+	`)
+	jgh.PanicOnErr(err)
+	addColumn(db, "cognosSessions", "heartbeat", "INTEGER NOT NULL DEFAULT 0")
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cognosQueue (
+			id TEXT PRIMARY KEY,
+			environment TEXT NOT NULL,
+			username TEXT NOT NULL,
+			enqueued INTEGER NOT NULL,
+			checkedIn INTEGER NOT NULL
+		)
+	`)
+	jgh.PanicOnErr(err)
+}
+
+// a running report or a request waiting to run one
+type cognosSlot struct {
+	id          string
+	environment string
+	username    string
+}
+
+// the limits on how many reports can run at once. 0 means no limit.
+func cognosLimits() (overall int, perUser map[string]int) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	overall = int(config.MaxConcurrentReports)
+	perUser = map[string]int{"": int(config.MaxReportsPerUser)}
+	for name, env := range config.environments {
+		perUser[name] = int(env.MaxReportsPerUser)
+	}
+	return
+}
+
+// wait for a turn to run a report in Cognos as a user. Requests get turns
+// in the order they asked, except that a request that can't run because
+// its user is busy doesn't hold up requests for other users. Call done
+// when the report has finished.
+func startCognosSession(envName string, username string) (done func()) {
+	overall, perUser := cognosLimits()
+	limited := overall > 0 || perUser[envName] > 0
+	me := cognosSlot{
+		id:          jgh.RandomString(16),
+		environment: envName,
+		username:    username,
+	}
+
+	// keep our session alive until we are done
+	stopHeartbeat := make(chan struct{})
+	heartbeat := func() {
+		ticker := time.NewTicker(cognosHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopHeartbeat:
+				return
+			case now := <-ticker.C:
+				// a missed heartbeat is not worth failing a report over
+				jgh.Try(0, 1, false, "", func() bool {
+					withDatabase(func(db *sql.DB) {
+						_, err := db.Exec(
+							"UPDATE cognosSessions SET heartbeat = ? WHERE id = ?",
+							now.Unix(),
+							me.id,
+						)
+						jgh.PanicOnErr(err)
+					})
+					return true
+				})
+			}
+		}
+	}
+	done = func() {
+		close(stopHeartbeat)
+		withDatabase(func(db *sql.DB) {
+			_, err := db.Exec("DELETE FROM cognosSessions WHERE id = ?", me.id)
+			jgh.PanicOnErr(err)
+		})
+	}
+	leaveQueue := func() {
+		withDatabase(func(db *sql.DB) {
+			_, err := db.Exec("DELETE FROM cognosQueue WHERE id = ?", me.id)
+			jgh.PanicOnErr(err)
+		})
+	}
+
+	// without limits we just keep track of the session for leastBusy
+	if !limited {
+		withDatabase(func(db *sql.DB) {
+			createCognosSessionsTable(db)
+
+			now := time.Now()
+			_, err := db.Exec(`
+				INSERT INTO cognosSessions
+					(id, environment, username, started, heartbeat)
+				VALUES
+					(?, ?, ?, ?, ?)
+			`, me.id, envName, username, now.Unix(), now.Unix())
+			jgh.PanicOnErr(err)
+			// clean up after processes that didn't call done
+			_, err = db.Exec(
+				"DELETE FROM cognosSessions WHERE heartbeat < ?",
+				now.Add(-staleCognosSession).Unix(),
+			)
+			jgh.PanicOnErr(err)
+		})
+		go heartbeat()
+		return done
+	}
+
+	withDatabase(func(db *sql.DB) {
+		createCognosSessionsTable(db)
+
+		now := time.Now()
+		_, err := db.Exec(`
+			INSERT INTO cognosQueue
+				(id, environment, username, enqueued, checkedIn)
+			VALUES
+				(?, ?, ?, ?, ?)
+		`, me.id, envName, username, now.UnixNano(), now.Unix())
+		jgh.PanicOnErr(err)
+	})
+
+	giveUpAt := time.Now().Add(maxCognosQueueWait)
+	lastCheckIn := time.Now()
+	poll := minCognosQueuePoll
+	for {
+		var ourTurn bool
+		success, errorMessage := jgh.Try(0, 1, false, "", func() bool {
+			// only take the write lock if it looks like our turn, or if
+			// we need to check in so we don't lose our place
+			if cognosTurnLooksFree(me, overall, perUser) {
+				ourTurn = takeCognosTurn(me, overall, perUser)
+				lastCheckIn = time.Now()
+			} else if time.Since(lastCheckIn) >= cognosQueueCheckIn {
+				checkInCognosQueue(me)
+				lastCheckIn = time.Now()
+			}
+			return true
+		})
+		if !success {
+			leaveQueue()
+			panic(errorMessage)
+		}
+		if ourTurn {
+			go heartbeat()
+			return done
+		}
+		if time.Now().After(giveUpAt) {
+			leaveQueue()
+			panic("503 Too many reports are running in Cognos. Try again later.")
+		}
+		time.Sleep(poll)
+		poll *= 2
+		if poll > maxCognosQueuePoll {
+			poll = maxCognosQueuePoll
+		}
+	}
+}
+
+// let other requests know we are still waiting
+func checkInCognosQueue(me cognosSlot) {
+	withDatabase(func(db *sql.DB) {
+		_, err := db.Exec(
+			"UPDATE cognosQueue SET checkedIn = ? WHERE id = ?",
+			time.Now().Unix(),
+			me.id,
+		)
+		jgh.PanicOnErr(err)
+	})
+}
+
+// see if it is our turn without writing anything. Abandoned sessions and
+// queue entries are skipped instead of deleted. takeCognosTurn has to
+// check again, since things may change before it gets the lock.
+func cognosTurnLooksFree(me cognosSlot, overall int, perUser map[string]int) (free bool) {
+	withDatabase(func(db *sql.DB) {
+		free = isCognosTurn(db, me, overall, perUser, time.Now())
+	})
+	return
+}
+
+// check in, clean up abandoned sessions and queue entries, and if it is
+// our turn move from the queue to the running sessions. Requests before
+// us that fit keep their place as long as they have checked in recently.
+func takeCognosTurn(me cognosSlot, overall int, perUser map[string]int) (ourTurn bool) {
+	withDatabase(func(db *sql.DB) {
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		// write first so we hold the lock for the whole transaction.
+		// Otherwise another process could take the same turn.
+		now := time.Now()
+		_, err = tx.Exec(
+			"UPDATE cognosQueue SET checkedIn = ? WHERE id = ?",
+			now.Unix(),
+			me.id,
+		)
+		jgh.PanicOnErr(err)
+		_, err = tx.Exec(
+			"DELETE FROM cognosQueue WHERE checkedIn < ?",
+			now.Add(-staleQueueEntry).Unix(),
+		)
+		jgh.PanicOnErr(err)
+		_, err = tx.Exec(
+			"DELETE FROM cognosSessions WHERE heartbeat < ?",
+			now.Add(-staleCognosSession).Unix(),
+		)
+		jgh.PanicOnErr(err)
+
+		ourTurn = isCognosTurn(tx, me, overall, perUser, now)
+		if !ourTurn {
+			return
+		}
+
+		_, err = tx.Exec("DELETE FROM cognosQueue WHERE id = ?", me.id)
+		jgh.PanicOnErr(err)
+		_, err = tx.Exec(`
+			INSERT INTO cognosSessions
+				(id, environment, username, started, heartbeat)
+			VALUES
+				(?, ?, ?, ?, ?)
+		`, me.id, me.environment, me.username, now.Unix(), now.Unix())
+		jgh.PanicOnErr(err)
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+	})
+	return
+}
+
+// go through the queue in order, giving a turn to every request that fits
+// in the limits, and see if we get one. Sessions and queue entries that
+// have been abandoned don't count.
+func isCognosTurn(
+	db queryer,
+	me cognosSlot,
+	overall int,
+	perUser map[string]int,
+	now time.Time,
+) (ourTurn bool) {
+	// count what is running
+	running := 0
+	userRunning := make(map[cognosSlot]int)
+	rows, err := db.Query(
+		"SELECT environment, username FROM cognosSessions WHERE heartbeat >= ?",
+		now.Add(-staleCognosSession).Unix(),
+	)
+	jgh.PanicOnErr(err)
+	for rows.Next() {
+		var session cognosSlot
+		err = rows.Scan(&session.environment, &session.username)
+		jgh.PanicOnErr(err)
+		running++
+		userRunning[session]++
+	}
+	jgh.PanicOnErr(rows.Err())
+	rows.Close()
+
+	rows, err = db.Query(`
+		SELECT id, environment, username
+		FROM cognosQueue
+		WHERE checkedIn >= ? OR id = ?
+		ORDER BY enqueued, id
+	`, now.Add(-staleQueueEntry).Unix(), me.id)
+	jgh.PanicOnErr(err)
+	var queue []cognosSlot
+	for rows.Next() {
+		var waiting cognosSlot
+		err = rows.Scan(&waiting.id, &waiting.environment, &waiting.username)
+		jgh.PanicOnErr(err)
+		queue = append(queue, waiting)
+	}
+	jgh.PanicOnErr(rows.Err())
+	rows.Close()
+
+	for _, waiting := range queue {
+		user := cognosSlot{
+			environment: waiting.environment,
+			username:    waiting.username,
+		}
+		if overall > 0 && running >= overall {
+			break
+		}
+		if limit := perUser[waiting.environment]; limit > 0 &&
+			userRunning[user] >= limit {
+			continue
+		}
+		if waiting.id == me.id {
+			ourTurn = true
+			break
+		}
+		running++
+		userRunning[user]++
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// headers browsers may send to us from another origin
+const corsAllowHeaders = "Authorization, Content-Type, X-API-Key, " +
+	"X-Cognos-Environment, Prefer, Cache-Control"
+
+// headers of ours that scripts on another origin may read
+const corsExposeHeaders = "X-Report-Password, X-Cache, X-Stale, Warning, " +
+	"ETag, Location, Retry-After, Content-Disposition"
+
+// an origin is a scheme and host with no path (ex: https://example.com)
+func validOrigin(origin string) bool {
+	parsed, err := url.Parse(origin)
+	return err == nil &&
+		(parsed.Scheme == "http" || parsed.Scheme == "https") &&
+		parsed.Host != "" &&
+		parsed.Path == "" &&
+		parsed.RawQuery == "" &&
+		parsed.Fragment == ""
+}
+
+// check if an origin is in a list. "*" allows any origin.
+func originAllowed(origin string, allowed []string) bool {
+	for _, allowedOrigin := range allowed {
+		if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// check the Origin header against the allowed origins in config.json.
+// Leaving out the CORS headers only stops a page from reading the
+// response. A form on another site can still make the browser send a
+// request with its saved basic auth, so requests from other origins have
+// to be turned away.
+func checkOrigin(request *http.Request) {
+	config.mutex.Lock()
+	allowedOrigins := config.AllowedOrigins
+	config.mutex.Unlock()
+
+	origin := request.Header.Get("Origin")
+	if origin == "" || len(allowedOrigins) == 0 {
+		return
+	}
+	if !originAllowed(origin, allowedOrigins) {
+		panic("403 Forbidden: Requests from " + origin + " are not allowed")
+	}
+}
+
+// set the CORS headers for a response. If config.json has no allowed
+// origins, any web page can use us, but browsers won't send cookies or
+// basic auth (scripts can still send X-API-Key or Authorization
+// themselves). Otherwise only the allowed origins get CORS headers, and
+// they can also make credentialed requests. Keys can limit this further
+// (see keyMetadata).
+func setCORSHeaders(response http.ResponseWriter, request *http.Request) {
+	config.mutex.Lock()
+	allowedOrigins := config.AllowedOrigins
+	config.mutex.Unlock()
+
+	header := response.Header()
+	origin := request.Header.Get("Origin")
+	// "*" can't be used with credentials, so it means the same as no list
+	if len(allowedOrigins) == 0 || originAllowed("", allowedOrigins) {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// the response depends on the origin, so caches need to know
+		header.Add("Vary", "Origin")
+		if origin == "" || !originAllowed(origin, allowedOrigins) {
+			return
+		}
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	header.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+	if request.Method == "OPTIONS" {
+		header.Set("Access-Control-Allow-Methods",
+			"GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		header.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		header.Set("Access-Control-Max-Age", "600")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/9072997/jgh"
+	"github.com/natefinch/atomic"
+)
+
+// Cognos passwords in config.json can be encrypted with AES-256-GCM. These
+// look like enc:v1:{base64 of nonce and ciphertext}.
+const encryptedCredentialPrefix = "enc:v1:"
+
+// the key can come from this environment variable (base64), or from a
+// file. The file is credentials.key next to config.json unless
+// credentialKeyFile is set.
+const credentialKeyEnv = "CARLSAGAN_CREDENTIAL_KEY"
+const defaultCredentialKeyFile = "credentials.key"
+
+// where the credential key file is. Relative paths are relative to
+// config.json.
+func credentialKeyPath(configPath string, keyFile string) string {
+	if keyFile == "" {
+		keyFile = defaultCredentialKeyFile
+	}
+	if !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(filepath.Dir(configPath), keyFile)
+	}
+	return keyFile
+}
+
+// read the credential key. If create is true and there is no key, a new
+// one is made and saved to the key file.
+func loadCredentialKey(configPath string, keyFile string, create bool) []byte {
+	encodedKey := os.Getenv(credentialKeyEnv)
+	if encodedKey == "" {
+		keyPath := credentialKeyPath(configPath, keyFile)
+		keyBytes, err := ioutil.ReadFile(keyPath)
+		if errors.Is(err, os.ErrNotExist) && create {
+			key := make([]byte, 32)
+			_, err = rand.Read(key)
+			jgh.PanicOnErr(err)
+			encodedKey = base64.StdEncoding.EncodeToString(key)
+			err = ioutil.WriteFile(keyPath, []byte(encodedKey+"\n"), 0600)
+			jgh.PanicOnErr(err)
+			return key
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			panic("config.json has encrypted Cognos passwords, but there " +
+				"is no " + keyPath + " and " + credentialKeyEnv + " is not set")
+		}
+		jgh.PanicOnErr(err)
+		encodedKey = string(keyBytes)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil || len(key) != 32 {
+		panic("The credential key must be 32 bytes of base64")
+	}
+	return key
+}
+
+func credentialCipher(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	jgh.PanicOnErr(err)
+	aead, err := cipher.NewGCM(block)
+	jgh.PanicOnErr(err)
+	return aead
+}
+
+// encrypt a Cognos password for config.json
+func encryptCredential(key []byte, password string) string {
+	aead := credentialCipher(key)
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	jgh.PanicOnErr(err)
+	sealed := aead.Seal(nonce, nonce, []byte(password), nil)
+	return encryptedCredentialPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// decrypt a Cognos password from config.json
+func decryptCredential(key []byte, encrypted string) string {
+	aead := credentialCipher(key)
+	sealed, err := base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(encrypted, encryptedCredentialPrefix),
+	)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		panic("An encrypted Cognos password in config.json is not valid")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	password, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+	if err != nil {
+		panic("An encrypted Cognos password in config.json could not be " +
+			"decrypted. Check the credential key.")
+	}
+	return string(password)
+}
+
+// return a copy of passwords with any encrypted ones decrypted. key is
+// only called if there is something to decrypt, so a key is not needed if
+// nothing is encrypted.
+func decryptCredentials(
+	passwords map[string]string,
+	key func() []byte,
+) map[string]string {
+	decrypted := make(map[string]string)
+	for username, password := range passwords {
+		if strings.HasPrefix(password, encryptedCredentialPrefix) {
+			password = decryptCredential(key(), password)
+		}
+		decrypted[username] = password
+	}
+	return decrypted
+}
+
+// change the Cognos passwords in config.json. This is used by the
+// --set-credential and --encrypt-credentials commands, so the rest of the
+// file is kept as it is (except for formatting and the order of keys).
+// update is called with the cognosUserPasswords of the default environment
+// (envName "") and each named environment, and returns true if it changed
+// anything. If nothing was changed, config.json is left alone.
+func editCredentials(
+	configPath string,
+	update func(key []byte, envName string, passwords map[string]string) bool,
+) {
+	configJSON, err := ioutil.ReadFile(configPath)
+	jgh.PanicOnErr(err)
+	var top map[string]json.RawMessage
+	err = json.Unmarshal(configJSON, &top)
+	jgh.PanicOnErr(err)
+
+	var keyFile string
+	if raw, exists := top["credentialKeyFile"]; exists {
+		err = json.Unmarshal(raw, &keyFile)
+		jgh.PanicOnErr(err)
+	}
+	key := loadCredentialKey(configPath, keyFile, true)
+
+	// update the passwords in an object from config.json
+	changed := false
+	updateObject := func(envName string, object map[string]json.RawMessage) {
+		passwords := make(map[string]string)
+		raw, hadPasswords := object["cognosUserPasswords"]
+		if hadPasswords {
+			err := json.Unmarshal(raw, &passwords)
+			jgh.PanicOnErr(err)
+		}
+		if !update(key, envName, passwords) {
+			return
+		}
+		changed = true
+		// an environment without it's own users uses the default users,
+		// so don't give it an empty list
+		if !hadPasswords && len(passwords) == 0 {
+			return
+		}
+		raw, err := json.Marshal(passwords)
+		jgh.PanicOnErr(err)
+		object["cognosUserPasswords"] = raw
+	}
+
+	updateObject("", top)
+	if rawEnvs, exists := top["environments"]; exists {
+		var envs map[string]map[string]json.RawMessage
+		err = json.Unmarshal(rawEnvs, &envs)
+		jgh.PanicOnErr(err)
+		for name, env := range envs {
+			updateObject(name, env)
+		}
+		top["environments"], err = json.Marshal(envs)
+		jgh.PanicOnErr(err)
+	}
+
+	if !changed {
+		return
+	}
+	configJSON, err = json.MarshalIndent(top, "", "\t")
+	jgh.PanicOnErr(err)
+	// make sure we didn't break anything before we replace the file
+	var check configFile
+	err = json.Unmarshal(configJSON, &check)
+	jgh.PanicOnErr(err)
+	err = atomic.WriteFile(configPath, bytes.NewReader(append(configJSON, '\n')))
+	jgh.PanicOnErr(err)
+}
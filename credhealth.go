@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// how each Cognos user's logins have been going. This is kept in the
+// database so it is shared between CGI processes. Each environment is
+// tracked separately since they can point at different Cognos servers.
+type credentialStatus struct {
+	Environment string     `json:"environment"`
+	Username    string     `json:"username"`
+	Healthy     bool       `json:"healthy"`
+	Failures    int        `json:"failures"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	// how many reports this user is running right now
+	Active int `json:"active"`
+	// when round robin last picked this user
+	lastPicked int64
+}
+
+// ways to pick a user for public reports
+const (
+	// any healthy user
+	strategyRandom = "random"
+	// the healthy user that was picked longest ago
+	strategyRoundRobin = "roundRobin"
+	// the healthy user running the fewest reports
+	strategyLeastBusy = "leastBusy"
+	// the same user for a report each time, as long as they are healthy
+	strategyPinned = "pinned"
+)
+
+// if a login fails we try another user, but if Cognos is down we don't
+// want to wait for every user to time out
+const maxLoginAttempts = 3
+
+func createCredentialHealthTable(db *sql.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS credentialHealth (
+			environment TEXT NOT NULL,
+			username TEXT NOT NULL,
+			failures INTEGER NOT NULL DEFAULT 0,
+			lastSuccess INTEGER NOT NULL DEFAULT 0,
+			lastFailure INTEGER NOT NULL DEFAULT 0,
+			lastError TEXT NOT NULL DEFAULT '',
+			lastPicked INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (environment, username)
+		)
+	`)
+	jgh.PanicOnErr(err)
+	addColumn(db, "credentialHealth", "lastPicked", "INTEGER NOT NULL DEFAULT 0")
+	createCognosSessionsTable(db)
+}
+
+// get the status of the users in an environment. Users we have never
+// tried are healthy.
+func credentialHealth(envName string, usernames []string) (statuses []credentialStatus) {
+	withDatabase(func(db *sql.DB) {
+		createCredentialHealthTable(db)
+		statuses = readCredentialHealth(db, envName, usernames)
+	})
+	return
+}
+
+func readCredentialHealth(
+	db queryer,
+	envName string,
+	usernames []string,
+) []credentialStatus {
+	statuses := make([]credentialStatus, 0, len(usernames))
+	for _, username := range usernames {
+		status := credentialStatus{
+			Environment: envName,
+			Username:    username,
+		}
+		var lastSuccess, lastFailure int64
+		row := db.QueryRow(`
+			SELECT failures, lastSuccess, lastFailure, lastError, lastPicked
+			FROM credentialHealth
+			WHERE environment = ? AND username = ?
+		`, envName, username)
+		err := row.Scan(
+			&status.Failures,
+			&lastSuccess,
+			&lastFailure,
+			&status.LastError,
+			&status.lastPicked,
+		)
+		if err != sql.ErrNoRows {
+			jgh.PanicOnErr(err)
+		}
+		row = db.QueryRow(`
+			SELECT COUNT(*)
+			FROM cognosSessions
+			WHERE environment = ? AND username = ? AND heartbeat >= ?
+		`, envName, username, time.Now().Add(-staleCognosSession).Unix())
+		err = row.Scan(&status.Active)
+		jgh.PanicOnErr(err)
+		status.Healthy = status.Failures == 0
+		if lastSuccess != 0 {
+			t := time.Unix(lastSuccess, 0)
+			status.LastSuccess = &t
+		}
+		if lastFailure != 0 {
+			t := time.Unix(lastFailure, 0)
+			status.LastFailure = &t
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// the order to try users in for a public report. Users whose password
+// has not been rejected come first, in the order picked by the
+// environment's credentialStrategy. Users whose password was rejected come
+// last, starting with the one that failed longest ago, since it may have
+// been changed since.
+func credentialOrder(
+	envName string,
+	env cognosEnvironment,
+	reportPath string,
+) (usernames []string) {
+	var all []string
+	for username := range env.CognosUserPasswords {
+		all = append(all, username)
+	}
+	sort.Strings(all)
+	roundRobin := env.CredentialStrategy == strategyRoundRobin
+
+	withDatabase(func(db *sql.DB) {
+		createCredentialHealthTable(db)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		// for round robin, write first so we hold the lock until we have
+		// recorded our pick. Otherwise requests at the same time would
+		// pick the same user.
+		if roundRobin {
+			_, err = tx.Exec(
+				"UPDATE credentialHealth SET lastPicked = lastPicked WHERE environment = ?",
+				envName,
+			)
+			jgh.PanicOnErr(err)
+		}
+
+		statuses := readCredentialHealth(tx, envName, all)
+		usernames = orderCredentials(statuses, env.CredentialStrategy, reportPath)
+
+		if roundRobin && len(usernames) > 0 {
+			// remember when round robin picked a user. This is shared
+			// between CGI processes.
+			_, err = tx.Exec(`
+				INSERT INTO credentialHealth
+					(environment, username, lastPicked)
+				VALUES
+					(?, ?, ?)
+				ON CONFLICT (environment, username) DO UPDATE SET
+					lastPicked = excluded.lastPicked
+			`, envName, usernames[0], time.Now().UnixNano())
+			jgh.PanicOnErr(err)
+		}
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+	})
+	return
+}
+
+// sort users for credentialOrder
+func orderCredentials(
+	statuses []credentialStatus,
+	strategy string,
+	reportPath string,
+) (usernames []string) {
+	var healthy, failing []credentialStatus
+	for _, status := range statuses {
+		if status.Healthy {
+			healthy = append(healthy, status)
+		} else {
+			failing = append(failing, status)
+		}
+	}
+
+	// jgh.Rand is seeded from crypto/rand. The global math/rand source is
+	// not seeded in older versions of Go, so every CGI process would
+	// shuffle the same way.
+	shuffle := func() {
+		jgh.Rand.Shuffle(len(healthy), func(i, j int) {
+			healthy[i], healthy[j] = healthy[j], healthy[i]
+		})
+	}
+	switch strategy {
+	case strategyRoundRobin:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].lastPicked < healthy[j].lastPicked
+		})
+	case strategyLeastBusy:
+		shuffle()
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].Active < healthy[j].Active
+		})
+	case strategyPinned:
+		// rendezvous hashing, so if a user is taken out only the reports
+		// pinned to them move
+		score := func(username string) string {
+			hash := sha256.Sum256([]byte(username + "\x00" + reportPath))
+			return string(hash[:])
+		}
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return score(healthy[i].Username) > score(healthy[j].Username)
+		})
+	default:
+		shuffle()
+	}
+	sort.SliceStable(failing, func(i, j int) bool {
+		return failing[i].LastFailure.Before(*failing[j].LastFailure)
+	})
+
+	for _, status := range append(healthy, failing...) {
+		usernames = append(usernames, status.Username)
+	}
+	return
+}
+
+// a user logged in to Cognos
+func recordCredentialSuccess(envName string, username string) {
+	withDatabase(func(db *sql.DB) {
+		createCredentialHealthTable(db)
+
+		_, err := db.Exec(`
+			INSERT INTO credentialHealth
+				(environment, username, lastSuccess)
+			VALUES
+				(?, ?, ?)
+			ON CONFLICT (environment, username) DO UPDATE SET
+				failures = 0,
+				lastSuccess = excluded.lastSuccess
+		`, envName, username, time.Now().Unix())
+		jgh.PanicOnErr(err)
+	})
+}
+
+// Cognos rejected a user's password. This takes them out of the rotation
+// for public folder reports until they log in again.
+func recordCredentialFailure(envName string, username string, errorMessage string) {
+	// errors can include a whole page of HTML from Cognos
+	if len(errorMessage) > 500 {
+		errorMessage = errorMessage[:500]
+	}
+	withDatabase(func(db *sql.DB) {
+		createCredentialHealthTable(db)
+
+		_, err := db.Exec(`
+			INSERT INTO credentialHealth
+				(environment, username, failures, lastFailure, lastError)
+			VALUES
+				(?, ?, 1, ?, ?)
+			ON CONFLICT (environment, username) DO UPDATE SET
+				failures = failures + 1,
+				lastFailure = excluded.lastFailure,
+				lastError = excluded.lastError
+		`, envName, username, time.Now().Unix(), errorMessage)
+		jgh.PanicOnErr(err)
+	})
+}
+
+// put a user back in the rotation after their password was changed
+func clearCredentialFailures(envName string, username string) {
+	withDatabase(func(db *sql.DB) {
+		createCredentialHealthTable(db)
+
+		_, err := db.Exec(`
+			UPDATE credentialHealth
+			SET failures = 0, lastError = ''
+			WHERE environment = ? AND username = ?
+		`, envName, username)
+		jgh.PanicOnErr(err)
+	})
+}
+
+// the status of every Cognos user in every environment
+func allCredentialHealth() (statuses []credentialStatus) {
+	config.mutex.Lock()
+	envUsers := make(map[string][]string)
+	envNames := []string{""}
+	for name := range config.environments {
+		envNames = append(envNames, name)
+	}
+	for _, name := range envNames {
+		env, _ := getEnvironment(name)
+		for username := range env.CognosUserPasswords {
+			envUsers[name] = append(envUsers[name], username)
+		}
+		sort.Strings(envUsers[name])
+	}
+	config.mutex.Unlock()
+
+	sort.Strings(envNames)
+	statuses = []credentialStatus{}
+	for _, name := range envNames {
+		statuses = append(statuses, credentialHealth(name, envUsers[name])...)
+	}
+	return
+}
+
+// GET /credentials shows how logins for each Cognos user have been going.
+// This requires the master password. Passwords are never shown.
+func handleCredentialsRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	providedPassword string,
+) {
+	if !isMasterPassword(providedPassword) {
+		response.Header().Set("WWW-Authenticate", `Basic realm="Carl Sagan"`)
+		response.Header().Set("Content-Type", "text/plain")
+		response.WriteHeader(401)
+		_, err := response.Write([]byte("Unauthorised: Viewing Cognos " +
+			"credentials requires the master password\n"))
+		jgh.PanicOnErr(err)
+		return
+	}
+	if request.Method != "GET" {
+		response.Header().Set("Content-Type", "text/plain")
+		response.WriteHeader(405)
+		_, err := response.Write([]byte("Use GET /credentials\n"))
+		jgh.PanicOnErr(err)
+		return
+	}
+
+	statusJSON, err := json.MarshalIndent(allCredentialHealth(), "", "\t")
+	jgh.PanicOnErr(err)
+	response.Header().Set("Content-Type", "application/json")
+	_, err = response.Write(statusJSON)
+	jgh.PanicOnErr(err)
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,25 +20,51 @@ import (
 	"github.com/iancoleman/strcase"
 )
 
+// the settings that come from config.json. We never write to config.json
+// (except to create a template). Anything we generate goes in the
+// database.
+type configFile struct {
+	// the default environment's settings are at the top level
+	cognosEnvironment
+	Environments map[string]json.RawMessage `json:"environments,omitempty"`
+	// report passwords used to be kept in config.json. These are moved
+	// into the database the first time we see them.
+	ReportPasswords      map[string]string `json:"reportPasswords,omitempty"`
+	MasterPassword       string            `json:"masterPassword"`
+	KeepStale            uint              `json:"keepStale"`
+	StaleWhileRevalidate uint              `json:"staleWhileRevalidate"`
+	BreakerThreshold     int               `json:"breakerThreshold"`
+	BreakerOpenFor       uint              `json:"breakerOpenFor"`
+	URLPrefix            string            `json:"urlPrefix"`
+	TrustedProxies       []string          `json:"trustedProxies"`
+	AllowedOrigins       []string          `json:"allowedOrigins"`
+	AuditRetentionDays   uint              `json:"auditRetentionDays"`
+	LockoutThreshold     int               `json:"lockoutThreshold"`
+	LockoutDuration      uint              `json:"lockoutDuration"`
+	// don't create report passwords when the master password is used
+	ManualReportPasswords bool         `json:"manualReportPasswords"`
+	JWT                   *jwtSettings `json:"jwt,omitempty"`
+	// how many reports can run in Cognos at once across all users and
+	// environments. 0 means no limit.
+	MaxConcurrentReports uint `json:"maxConcurrentReports"`
+	// the key for encrypted Cognos passwords (see credentials.go)
+	CredentialKeyFile string `json:"credentialKeyFile,omitempty"`
+	// parsed from Environments
+	environments map[string]cognosEnvironment
+}
+
 var config struct {
-	CognosUserPasswords map[string]string `json:"cognosUserPasswords"`
-	CognosURL           string            `json:"cognosUrl"`
-	ReportPasswords     map[string]string `json:"reportPasswords"`
-	MasterPassword      string            `json:"masterPassword"`
-	RetryDelay          uint              `json:"retryDelay"`
-	RetryCount          int               `json:"retryCount"`
-	HTTPTimeout         uint              `json:"httpTimeout"`
-	MaxAge              uint              `json:"maxAge"`
-	configPath          string
-	mutex               sync.Mutex
+	configFile
+	configPath string
+	mutex      sync.Mutex
 }
 
 const minMsForPasswordCheck = 100
 
 // Lock the mutex before calling
 func readConfig(filename string) {
-	configJSON, err := ioutil.ReadFile(filename)
-	if err != nil {
+	_, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
 		// make a spot for 1 user in the config template
 		config.CognosUserPasswords = map[string]string{"": ""}
 
@@ -42,23 +73,72 @@ func readConfig(filename string) {
 			"same folder as this executable")
 	}
 
-	err = json.Unmarshal(configJSON, &config)
+	config.configFile = parseConfigFile(filename)
+}
+
+// read and validate a config file. This does not touch the global config,
+// so a bad file can't leave us with half of a config.
+func parseConfigFile(filename string) (newConfig configFile) {
+	configJSON, err := ioutil.ReadFile(filename)
+	jgh.PanicOnErr(err)
+
+	err = json.Unmarshal(configJSON, &newConfig)
 	jgh.PanicOnErr(err)
 
-	// make sure we have at least 1 Cognos user
-	if len(config.CognosUserPasswords) == 0 {
-		panic("You must specify at least 1 Cognos user in the config file")
+	// Cognos passwords may be encrypted. They are only decrypted in
+	// memory.
+	var credentialKey []byte
+	getCredentialKey := func() []byte {
+		if credentialKey == nil {
+			credentialKey = loadCredentialKey(
+				filename,
+				newConfig.CredentialKeyFile,
+				false,
+			)
+		}
+		return credentialKey
 	}
+	newConfig.CognosUserPasswords = decryptCredentials(
+		newConfig.CognosUserPasswords,
+		getCredentialKey,
+	)
 
-	// make sure we don't have a nil map
-	if config.ReportPasswords == nil {
-		config.ReportPasswords = make(map[string]string)
+	validateEnvironment("", newConfig.cognosEnvironment)
+	newConfig.environments = parseEnvironments(
+		newConfig.cognosEnvironment,
+		newConfig.Environments,
+	)
+	for name, env := range newConfig.environments {
+		env.CognosUserPasswords = decryptCredentials(
+			env.CognosUserPasswords,
+			getCredentialKey,
+		)
+		newConfig.environments[name] = env
 	}
+
+	validateJWTSettings(newConfig.JWT)
+	for _, origin := range newConfig.AllowedOrigins {
+		if origin != "*" && !validOrigin(origin) {
+			panic(origin + " in allowedOrigins is not an origin like https://example.com")
+		}
+	}
+	for _, proxy := range newConfig.TrustedProxies {
+		if parseIPRange(proxy) == nil {
+			panic(proxy + " in trustedProxies is not an IP address or CIDR range")
+		}
+	}
+
+	if len(newConfig.ReportPasswords) > 0 {
+		importReportPasswords(newConfig.ReportPasswords)
+	}
+
+	return
 }
 
+// this is only used to create a config template
 // Lock the mutex before calling
 func writeConfig(filename string) {
-	configJSON, err := json.MarshalIndent(config, "", "\t") //nolint
+	configJSON, err := json.MarshalIndent(&config, "", "\t")
 	jgh.PanicOnErr(err)
 	err = ioutil.WriteFile(filename, configJSON, 0600)
 	jgh.PanicOnErr(err)
@@ -73,37 +153,66 @@ func pathToString(path []string) string {
 	return strings.Join(path, "/")
 }
 
-// Lock the mutex before calling
-func createReportPassword(path []string) {
+// create a password for a report. If the report is already covered by a
+// password, this does nothing and returns "".
+func createReportPassword(path []string) (password string) {
 	pathString := pathToString(path)
 
-	// panic if we were asked to create a password for a
-	// report that already has one
-	if _, exists := config.ReportPasswords[pathString]; exists {
-		panic("Report password already exists for given path")
-	}
-
-	password := jgh.RandomString(64)
-	config.ReportPasswords[pathString] = password
-
-	// we modified the config, save it back to disk
-	writeConfig(config.configPath)
-}
+	// we only keep a hash, so this is the only time anyone sees it
+	newPassword := jgh.RandomString(64)
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		// if 2 processes get here at once, one of them will fail to
+		// commit and try again
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		for _, scope := range scopesForPath(path) {
+			var count int
+			row := tx.QueryRow(
+				"SELECT COUNT(*) FROM passwordScopes WHERE scope = ?",
+				scope,
+			)
+			err = row.Scan(&count)
+			jgh.PanicOnErr(err)
+			if count > 0 {
+				password = ""
+				return
+			}
+		}
 
-// Lock the mutex before calling
-func reportPassword(path []string) (hasPassword bool, password string) {
-	pathString := pathToString(path)
-	password, exists := config.ReportPasswords[pathString]
-	return exists, password
+		insertPassword(
+			tx,
+			[]string{pathString},
+			hashReportPassword(newPassword),
+			keyMetadata{Description: "Created when the master password was used"},
+		)
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+		password = newPassword
+	})
+	return
 }
 
 // this checks is a password is valid for a given path. If the master
 // password is used to authenticate to a previously unknown report, a
-// report password will be generated. It has a minimum execution time of
-// 100ms to guard against timeing attacks
-func AllowedAccess(providedPassword string, reportPath []string) (allowed bool) {
-	config.mutex.Lock()
-
+// report password will be generated and returned as newPassword. usedKey
+// says which password was used, for logging. remoteIP is checked against
+// the password's allowed IPs and recorded as where it was last used from.
+// restrictions are the limits on what the password can see. It has a
+// minimum execution time of 100ms to guard against timeing attacks
+func AllowedAccess(
+	providedPassword string,
+	reportPath []string,
+	remoteIP string,
+) (
+	allowed bool,
+	usedKey string,
+	newPassword string,
+	restrictions keyRestrictions,
+) {
 	// we use a wait group to enforce a minimum execution time to
 	// prevent timeing attacks
 	var waitGroup sync.WaitGroup
@@ -113,23 +222,59 @@ func AllowedAccess(providedPassword string, reportPath []string) (allowed bool)
 		waitGroup.Done()
 	}()
 
-	// do the actual check
+	config.mutex.Lock()
+	masterPassword := config.MasterPassword
+	manualPasswords := config.ManualReportPasswords
+	config.mutex.Unlock()
+
+	// do the actual check. The most specific password that matches wins.
 	allowed = false
-	hasReportPassword, password := reportPassword(reportPath)
-	if hasReportPassword && providedPassword == password {
-		allowed = true
-	} else if providedPassword == config.MasterPassword {
+	var rejection string
+	candidates := passwordsForPath(reportPath)
+	for _, stored := range candidates {
+		if stored.check(providedPassword) {
+			// if the password can't be used, keep looking in case a
+			// less specific password matches
+			if stored.expired() {
+				if rejection == "" {
+					rejection = "401 Unauthorised: This report password " +
+						"expired on " + stored.Expires.Format(time.RFC1123)
+				}
+				continue
+			}
+			if !stored.allowedFrom(remoteIP) {
+				log.Println("Report password", stored.ID, "was used from", remoteIP,
+					"which is not in its allowed IPs")
+				if rejection == "" {
+					rejection = "403 Forbidden: This report password can't " +
+						"be used from " + remoteIP
+				}
+				continue
+			}
+			allowed = true
+			usedKey = stored.ID + " (" + stored.Scope + ")"
+			restrictions = stored.restrictions()
+			recordPasswordUse(stored.ID, remoteIP)
+			break
+		}
+	}
+	if !allowed && checkMasterPassword(masterPassword, providedPassword) {
 		allowed = true
+		usedKey = "master password"
 		// if authenticated with the master password and there is
-		// not a report password yet, create one
-		if !hasReportPassword {
-			createReportPassword(reportPath)
+		// not a report password yet, create one (unless passwords are
+		// only made with the key management API)
+		if len(candidates) == 0 && !manualPasswords {
+			newPassword = createReportPassword(reportPath)
 		}
 	}
-	config.mutex.Unlock()
 
 	// wait for out minimum time
 	waitGroup.Wait()
+
+	if !allowed && rejection != "" {
+		panic(rejection)
+	}
 	return
 }
 
@@ -246,36 +391,103 @@ func csvToJSON(csvData string) string {
 	return string(jsonData)
 }
 
+// get the CSV data for a report, either from the cache or from Cognos.
+// generated is when the data was pulled from Cognos. path may start with
+// the name of an environment.
 func PrepareResponse(
-	asJSON bool,
 	path []string,
 	promptAnswers map[string]string,
-	maxAge uint,
-) (response string) {
+	opts cacheOptions,
+) (reportCSV string, generated time.Time, cacheStatus string) {
+	config.mutex.Lock()
+	envName, reportPath := splitEnvironment(path)
+	config.mutex.Unlock()
+
 	// path must contain a Namespace, DSN and something else
-	if len(path) < 3 {
+	if len(reportPath) < 3 {
 		panic("path must contain a Namespace, DSN and at least one other component")
 	}
 
-	// try to get the report from the cache
+	// try to get the report from the cache. The hash includes the
+	// environment name so environments don't share cache items.
 	hash := pathHash(path, promptAnswers)
-	reportCSV, age := getFromCache(hash)
+	cachedCSV, cachedGenerated, age := getFromCache(hash)
 	// if item was in cache and is new enough use the cache
-	if age != -1 && age <= int(maxAge) {
-		// this logic is duplicated from below so we can share cache items
-		// between applications that consume CSV and JSON
-		if asJSON {
-			return csvToJSON(reportCSV)
-		} else {
-			return reportCSV
+	if age != -1 && age <= opts.MaxAge {
+		return cachedCSV, cachedGenerated, cacheHit
+	}
+	// if the item is a little too old we may be allowed to serve it
+	// anyway and update it in the background
+	if age != -1 && age <= addSeconds(opts.MaxAge, opts.StaleWhileRevalidate) {
+		refreshInBackground(path, promptAnswers)
+		return cachedCSV, cachedGenerated, cacheHit
+	}
+	if opts.OnlyIfCached {
+		panic("504 The report is not in the cache")
+	}
+
+	// if Cognos is down, anything from the cache is better than nothing
+	if !cognosAvailable(envName) {
+		if age != -1 {
+			return cachedCSV, cachedGenerated, cacheStale
 		}
-	} else {
-		// this is a cache miss. That means this request is going to run for
-		// a while. Use this time to clean the cache. It's fine if this is
-		// interupted
-		go cleanCache()
+		panic("503 Cognos is unavailable and the report is not in the cache")
 	}
+
+	// this is a cache miss. That means this request is going to run for
+	// a while. Use this time to clean the cache. It's fine if this is
+	// interupted
+	go cleanCache()
+
 	// item was not in cache or was too old. Do the request as normal.
+	success, errorMessage := jgh.Try(0, 1, false, "", func() bool {
+		reportCSV = downloadReport(path, promptAnswers)
+		return true
+	})
+	if !success {
+		// the client may have said old data is better than no data
+		if age != -1 && age <= opts.StaleIfError {
+			return cachedCSV, cachedGenerated, cacheStale
+		}
+		// if that failure means Cognos is down, serve whatever we have
+		if age != -1 && !cognosAvailable(envName) {
+			return cachedCSV, cachedGenerated, cacheStale
+		}
+		panic(errorMessage)
+	}
+
+	if opts.NoStore {
+		return reportCSV, time.Now(), cacheMiss
+	}
+	generated = addToCache(hash, reportCSV)
+	return reportCSV, generated, cacheMiss
+}
+
+// run a report in Cognos and return the CSV data. This does not use the
+// cache.
+func downloadReport(path []string, promptAnswers map[string]string) string {
+	cognosInstance, path, done := openCognos(path)
+	defer done()
+	return cognosInstance.DownloadReportCSV(path, promptAnswers)
+}
+
+// log in to Cognos with the environment, namespace, DSN, and user from a
+// report path. cognosPath is what is left of the path for the cognos
+// library. This updates the circuit breaker. Call done when finished with
+// the session, so we know how busy each user is.
+func openCognos(path []string) (
+	cognosInstance cognos.Session,
+	cognosPath []string,
+	done func(),
+) {
+	// public reports are pinned to a user by their full path
+	reportPath := pathToString(path)
+
+	// the path may start with the name of an environment
+	config.mutex.Lock()
+	envName, path := splitEnvironment(path)
+	env, _ := getEnvironment(envName)
+	config.mutex.Unlock()
 
 	// first component of the path is Namespace
 	// second is DSN
@@ -284,60 +496,83 @@ func PrepareResponse(
 	dsn := path[1]
 	path = path[2:]
 
-	config.mutex.Lock()
-
 	// the next component of the path is either a username or "public".
 	// if it is a username, we need to set the user/password and change
 	// the root to "~". A "~" indicates "the current user's home folder"
 	// to our library.
-	var username, password string
+	var usernames []string
 	if path[0] == "public" {
 		// this got renamed in cognos 11
 		path[0] = "Team Content"
 
-		// grab any set of Cognos credentials
-		for username, password = range config.CognosUserPasswords {
-			break
+		// any user can run public reports. If a login fails, we try the
+		// next user.
+		usernames = credentialOrder(envName, env, reportPath)
+		if len(usernames) > maxLoginAttempts {
+			usernames = usernames[:maxLoginAttempts]
 		}
 	} else {
 		// usernames have backslashes in them, but putting one of those
 		// in a URL is awkward, so we allow using "_" insted
-		username = strings.Replace(path[0], "_", `\`, 1)
+		username := strings.Replace(path[0], "_", `\`, 1)
 
-		var userInConfig bool
-		password, userInConfig = config.CognosUserPasswords[username]
+		_, userInConfig := env.CognosUserPasswords[username]
 		if !userInConfig {
 			panic("no password for " + username + " in config file")
 		}
+		usernames = []string{username}
 
 		// our library expects "~" for the current user's folder
 		path[0] = "~"
 	}
 
-	cognosInstance := cognos.MakeInstance(
-		username,
-		password,
-		config.CognosURL,
-		namespace,
-		dsn,
-		config.RetryDelay,
-		config.RetryCount,
-		config.HTTPTimeout,
-		1,   // concurent requests
-		nil, // use default http transport
-	)
-
-	// talking to cognos can take a long time, so unlock before we start
-	config.mutex.Unlock()
-
-	reportCSV = cognosInstance.DownloadReportCSV(path, promptAnswers)
-	addToCache(hash, reportCSV)
-	if asJSON {
-		return csvToJSON(reportCSV)
-	} else {
-		// just return the CSV data as is from cognos
-		return reportCSV
+	// if we can't log in as anyone because of timeouts or server errors,
+	// we assume Cognos is down. A rejected password only means something
+	// is wrong with that user.
+	var errorMessage interface{}
+	cognosDown := false
+	for _, username := range usernames {
+		// wait for a turn before logging in, since logging in counts
+		// against Cognos's limit on sessions
+		done = startCognosSession(envName, username)
+
+		var success bool
+		success, errorMessage = jgh.Try(0, 1, false, "", func() bool {
+			cognosInstance = cognos.MakeInstance(
+				username,
+				env.CognosUserPasswords[username],
+				env.CognosURL,
+				namespace,
+				dsn,
+				env.RetryDelay,
+				env.RetryCount,
+				env.HTTPTimeout,
+				1,   // concurent requests
+				nil, // use default http transport
+			)
+			return true
+		})
+		if success {
+			recordCognosSuccess(envName)
+			recordCredentialSuccess(envName, username)
+			return cognosInstance, path, done
+		}
+		done()
+		// only a rejected password says something about the user. Other
+		// errors (timeouts, 5xx) happen to every user while Cognos is
+		// down.
+		httpErr, isHTTPErr := errorMessage.(cognos.HTTPError)
+		if isHTTPErr && httpErr.LoginRejected() {
+			recordCredentialFailure(envName, username, fmt.Sprint(errorMessage))
+		}
+		if !isHTTPErr || httpErr.StatusCode >= 500 {
+			cognosDown = true
+		}
+	}
+	if cognosDown {
+		recordCognosFailure(envName)
 	}
+	panic(errorMessage)
 }
 
 func ParsePath(path string) []string {
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/9072997/jgh"
+)
+
+// settings for talking to one Cognos server. The top level of config.json
+// is the default environment. Other environments are listed by name under
+// "environments", and are selected by putting their name in front of the
+// report path (ex: /dev/esp/bentonvisms/public/...). Anything not set for
+// a named environment is copied from the default environment.
+type cognosEnvironment struct {
+	CognosUserPasswords map[string]string   `json:"cognosUserPasswords"`
+	CognosURL           string              `json:"cognosUrl"`
+	RetryDelay          uint                `json:"retryDelay"`
+	RetryCount          int                 `json:"retryCount"`
+	HTTPTimeout         uint                `json:"httpTimeout"`
+	MaxAge              uint                `json:"maxAge"`
+	MaintenanceWindows  []maintenanceWindow `json:"maintenanceWindows"`
+	// how many reports each user can run at once. 0 means no limit.
+	MaxReportsPerUser uint `json:"maxReportsPerUser"`
+	// how a user is picked for public reports (see credentialOrder)
+	CredentialStrategy string `json:"credentialStrategy"`
+}
+
+// build named environments on top of the default environment
+func parseEnvironments(
+	defaultEnv cognosEnvironment,
+	rawEnvs map[string]json.RawMessage,
+) map[string]cognosEnvironment {
+	envs := make(map[string]cognosEnvironment)
+	for name, rawEnv := range rawEnvs {
+		if name == "" || name == "jobs" || name == "keys" || name == "audit" ||
+			name == "credentials" || strings.Contains(name, "/") {
+			panic(`"` + name + `" can't be used as an environment name`)
+		}
+
+		env := defaultEnv
+		// we don't want to merge users with the default environment, but
+		// we do want to use the default users if none were given
+		env.CognosUserPasswords = nil
+		env.MaintenanceWindows = nil
+		err := json.Unmarshal(rawEnv, &env)
+		jgh.PanicOnErr(err)
+		if env.CognosUserPasswords == nil {
+			env.CognosUserPasswords = defaultEnv.CognosUserPasswords
+		}
+		if env.MaintenanceWindows == nil {
+			env.MaintenanceWindows = defaultEnv.MaintenanceWindows
+		}
+
+		validateEnvironment(name, env)
+		envs[name] = env
+	}
+	return envs
+}
+
+// panic if an environment is not usable
+func validateEnvironment(name string, env cognosEnvironment) {
+	if name == "" {
+		name = "the default environment"
+	}
+
+	// make sure we have at least 1 Cognos user
+	if len(env.CognosUserPasswords) == 0 {
+		panic("You must specify at least 1 Cognos user for " + name)
+	}
+
+	switch env.CredentialStrategy {
+	case "", strategyRandom, strategyRoundRobin, strategyLeastBusy, strategyPinned:
+	default:
+		panic("credentialStrategy for " + name + " must be random, " +
+			"roundRobin, leastBusy, or pinned")
+	}
+
+	// make sure maintenance windows are valid now rather than when we
+	// need them
+	for _, window := range env.MaintenanceWindows {
+		window.parse()
+	}
+}
+
+// get an environment by name. "" is the default environment.
+// Lock the mutex before calling
+func getEnvironment(name string) (env cognosEnvironment, exists bool) {
+	if name == "" {
+		return config.cognosEnvironment, true
+	}
+	env, exists = config.environments[name]
+	return
+}
+
+// if a report path starts with the name of an environment, split it off.
+// Lock the mutex before calling
+func splitEnvironment(path []string) (name string, reportPath []string) {
+	if len(path) > 0 {
+		if _, exists := config.environments[path[0]]; exists {
+			return path[0], path[1:]
+		}
+	}
+	return "", path
+}
+
+// the longest any environment keeps things in the cache
+// Lock the mutex before calling
+func longestMaxAge() uint {
+	maxAge := config.MaxAge
+	for _, env := range config.environments {
+		if env.MaxAge > maxAge {
+			maxAge = env.MaxAge
+		}
+	}
+	return maxAge
+}
@@ -9,10 +9,11 @@ require (
 	github.com/antchfx/xpath v1.1.11 // indirect
 	github.com/go-ole/go-ole v1.2.5 // indirect
 	github.com/iancoleman/strcase v0.1.3
+	github.com/klauspost/compress v1.13.6
 	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/mitchellh/hashstructure v1.1.0
 	github.com/natefinch/atomic v0.0.0-20200526193002-18c0533a5b09
-	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad // indirect
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
 	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c // indirect
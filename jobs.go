@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// job statuses
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// finished jobs are kept at least this long, even when the cache does not
+// keep results that long, so a client polling a job always gets to see
+// that it finished
+const minJobRetention = time.Hour
+
+// a queued or running job updates its heartbeat this often. If it hasn't
+// for staleJob, the process running it was killed or restarted and the
+// job is marked failed.
+const jobHeartbeat = 10 * time.Second
+const staleJob = time.Minute
+
+// a report run that happens in the background. The result is not stored
+// with the job. It is stored in the cache like any other report, so a job
+// result is available for as long as the cache item is.
+type reportJob struct {
+	ID            string            `json:"id"`
+	Status        string            `json:"status"`
+	Path          []string          `json:"-"`
+	PromptAnswers map[string]string `json:"-"`
+	AsJSON        bool              `json:"-"`
+	MaxAge        int               `json:"-"`
+	Hash          string            `json:"-"`
+	Error         string            `json:"error,omitempty"`
+	Created       time.Time         `json:"created"`
+	Updated       time.Time         `json:"updated"`
+}
+
+func createJobsTable(db *sql.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS jobs (
+			id TEXT PRIMARY KEY,
+			status TEXT NOT NULL,
+			path TEXT NOT NULL,
+			promptAnswers TEXT NULL,
+			asJSON INTEGER NOT NULL,
+			maxAge INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			error TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			updated INTEGER NOT NULL,
+			heartbeat INTEGER NOT NULL
+		)
+	`)
+	jgh.PanicOnErr(err)
+	addColumn(db, "jobs", "heartbeat", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// mark queued and running jobs that have stopped updating their heartbeat
+// as failed. Otherwise they would look like they are running forever, and
+// refreshInBackground would never refresh their report again.
+func failAbandonedJobs(db *sql.DB) {
+	now := time.Now()
+	_, err := db.Exec(`
+		UPDATE jobs
+		SET status = ?, error = ?, updated = ?
+		WHERE status IN (?, ?) AND heartbeat < ?
+	`,
+		jobFailed,
+		"The job stopped before it finished (ex: the server restarted)",
+		now.Unix(),
+		jobQueued,
+		jobRunning,
+		now.Add(-staleJob).Unix(),
+	)
+	jgh.PanicOnErr(err)
+}
+
+// add a job to the database in the "queued" state. This does not start
+// the job.
+func createJob(
+	asJSON bool,
+	path []string,
+	promptAnswers map[string]string,
+	maxAge int,
+) reportJob {
+	now := time.Now()
+	job := reportJob{
+		ID:            jgh.RandomString(32),
+		Status:        jobQueued,
+		Path:          path,
+		PromptAnswers: promptAnswers,
+		AsJSON:        asJSON,
+		MaxAge:        maxAge,
+		Hash:          pathHash(path, promptAnswers),
+		Created:       now,
+		Updated:       now,
+	}
+	answersJSON, err := json.Marshal(promptAnswers)
+	jgh.PanicOnErr(err)
+
+	// results are only kept as long as cache items, so there is no reason
+	// to keep finished jobs older than that. updated is when a finished
+	// job finished. Queued and running jobs are never removed here.
+	config.mutex.Lock()
+	retention := time.Duration(longestMaxAge()+config.KeepStale) * time.Second
+	config.mutex.Unlock()
+	if retention < minJobRetention {
+		retention = minJobRetention
+	}
+	oldestFinish := now.Add(-retention).Unix()
+
+	withDatabase(func(db *sql.DB) {
+		createJobsTable(db)
+		failAbandonedJobs(db)
+
+		_, err := db.Exec(
+			"DELETE FROM jobs WHERE status IN (?, ?) AND updated < ?",
+			jobDone,
+			jobFailed,
+			oldestFinish,
+		)
+		jgh.PanicOnErr(err)
+
+		_, err = db.Exec(`
+			INSERT INTO jobs
+				(id, status, path, promptAnswers, asJSON, maxAge, hash,
+				error, created, updated, heartbeat)
+			VALUES
+				(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			job.ID,
+			job.Status,
+			pathToString(job.Path),
+			answersJSON,
+			job.AsJSON,
+			job.MaxAge,
+			job.Hash,
+			job.Error,
+			job.Created.Unix(),
+			job.Updated.Unix(),
+			now.Unix(),
+		)
+		jgh.PanicOnErr(err)
+	})
+
+	return job
+}
+
+// look up a job by ID. Returns nil if there is no such job
+func getJob(id string) (job *reportJob) {
+	withDatabase(func(db *sql.DB) {
+		createJobsTable(db)
+		failAbandonedJobs(db)
+
+		row := db.QueryRow(`
+			SELECT
+				status, path, promptAnswers, asJSON, maxAge, hash, error,
+				created, updated
+			FROM jobs
+			WHERE id = ?
+		`, id)
+
+		var pathStr, answersJSON string
+		var created, updated int64
+		j := reportJob{ID: id}
+		err := row.Scan(
+			&j.Status,
+			&pathStr,
+			&answersJSON,
+			&j.AsJSON,
+			&j.MaxAge,
+			&j.Hash,
+			&j.Error,
+			&created,
+			&updated,
+		)
+		if err == sql.ErrNoRows {
+			return
+		}
+		jgh.PanicOnErr(err)
+
+		j.Path = ParsePath(pathStr)
+		err = json.Unmarshal([]byte(answersJSON), &j.PromptAnswers)
+		jgh.PanicOnErr(err)
+		j.Created = time.Unix(created, 0)
+		j.Updated = time.Unix(updated, 0)
+		job = &j
+	})
+	return
+}
+
+func setJobStatus(id string, status string, errorMessage string) {
+	withDatabase(func(db *sql.DB) {
+		createJobsTable(db)
+
+		now := time.Now().Unix()
+		_, err := db.Exec(`
+			UPDATE jobs
+			SET status = ?, error = ?, updated = ?, heartbeat = ?
+			WHERE id = ?
+		`,
+			status,
+			errorMessage,
+			now,
+			now,
+			id,
+		)
+		jgh.PanicOnErr(err)
+	})
+}
+
+// run a job in the foreground and record the outcome in the database
+func runJob(id string) {
+	job := getJob(id)
+	if job == nil {
+		panic("no job with id " + id)
+	}
+
+	setJobStatus(id, jobRunning, "")
+	stopHeartbeat := make(chan struct{})
+	go jobHeartbeatLoop(id, stopHeartbeat)
+	defer close(stopHeartbeat)
+	success, errorMessage := jgh.Try(0, 1, false, "", func() bool {
+		// the result goes in the cache
+		PrepareResponse(job.Path, job.PromptAnswers, cacheOptions{
+			MaxAge:       job.MaxAge,
+			StaleIfError: -1,
+		})
+		return true
+	})
+	if success {
+		setJobStatus(id, jobDone, "")
+	} else {
+		if !runningAsCGI {
+			log.Println(errorMessage)
+		}
+		setJobStatus(id, jobFailed, fmt.Sprint(errorMessage))
+	}
+}
+
+// let other processes know a job is still running until stop is closed
+func jobHeartbeatLoop(id string, stop chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			// a missed heartbeat is not worth failing a job over
+			jgh.Try(0, 1, false, "", func() bool {
+				withDatabase(func(db *sql.DB) {
+					_, err := db.Exec(
+						"UPDATE jobs SET heartbeat = ? WHERE id = ?",
+						now.Unix(),
+						id,
+					)
+					jgh.PanicOnErr(err)
+				})
+				return true
+			})
+		}
+	}
+}
+
+// start a job in the background. When running as CGI our process exits
+// once the response is sent, so we start a copy of ourself to do the work.
+func startJob(id string) {
+	if !runningAsCGI {
+		// don't let a failed job take down the server
+		go jgh.Try(0, 1, false, "", func() bool {
+			runJob(id)
+			return true
+		})
+		return
+	}
+
+	exePath, err := os.Executable()
+	jgh.PanicOnErr(err)
+	cmd := exec.Command(exePath, "--job", id)
+	err = cmd.Start()
+	jgh.PanicOnErr(err)
+	// we are not going to wait for it
+	err = cmd.Process.Release()
+	jgh.PanicOnErr(err)
+}
+
+// start a job to update a report in the cache unless one is already
+// queued or running
+func refreshInBackground(path []string, promptAnswers map[string]string) {
+	hash := pathHash(path, promptAnswers)
+	var alreadyRunning bool
+	withDatabase(func(db *sql.DB) {
+		createJobsTable(db)
+		failAbandonedJobs(db)
+
+		row := db.QueryRow(
+			"SELECT COUNT(*) > 0 FROM jobs WHERE hash = ? AND status IN (?, ?)",
+			hash,
+			jobQueued,
+			jobRunning,
+		)
+		err := row.Scan(&alreadyRunning)
+		jgh.PanicOnErr(err)
+	})
+	if alreadyRunning {
+		return
+	}
+
+	job := createJob(false, path, promptAnswers, 0)
+	startJob(job.ID)
+}
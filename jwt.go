@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// how long we keep a JWKS we fetched from a URL before fetching it again
+const jwksMaxAge = time.Hour
+
+// if a token uses a key we don't have, we fetch the JWKS again, but not
+// more often than this
+const jwksMinAge = 5 * time.Minute
+
+// how much clock skew we allow when checking exp and nbf
+const jwtLeeway = time.Minute
+
+// settings for accepting "Authorization: Bearer" tokens from an identity
+// provider. Exactly 1 of JWKSURL and JWKSFile should be set.
+type jwtSettings struct {
+	Issuer   string    `json:"issuer"`
+	Audience string    `json:"audience"`
+	JWKSURL  string    `json:"jwksUrl"`
+	JWKSFile string    `json:"jwksFile"`
+	Rules    []jwtRule `json:"rules"`
+}
+
+// a token that has Claim set to Value gets access to Scopes. Scopes work
+// the same way as report password scopes. If Value is "" any value of the
+// claim matches. If the claim is a list, any item in the list can match.
+type jwtRule struct {
+	Claim  string   `json:"claim"`
+	Value  string   `json:"value"`
+	Scopes []string `json:"scopes"`
+}
+
+// panic if JWT settings are not usable
+func validateJWTSettings(settings *jwtSettings) {
+	if settings == nil {
+		return
+	}
+	if settings.Issuer == "" {
+		panic("jwt.issuer is required")
+	}
+	if (settings.JWKSURL == "") == (settings.JWKSFile == "") {
+		panic("Exactly 1 of jwt.jwksUrl and jwt.jwksFile must be set")
+	}
+	for _, rule := range settings.Rules {
+		if rule.Claim == "" {
+			panic("Every rule in jwt.rules needs a claim")
+		}
+		for _, scope := range rule.Scopes {
+			validateScope(scope)
+		}
+	}
+}
+
+// check if a bearer token gives access to a report. err is set if the
+// token is not valid at all.
+func jwtAllowedAccess(token string, reportPath []string) (
+	allowed bool,
+	usedKey string,
+	err error,
+) {
+	config.mutex.Lock()
+	settings := config.JWT
+	configPath := config.configPath
+	config.mutex.Unlock()
+	if settings == nil {
+		return false, "", errors.New("bearer tokens are not enabled on this server")
+	}
+
+	claims, err := verifyJWT(token, *settings, configPath)
+	if err != nil {
+		return false, "", err
+	}
+
+	subject, _ := claims["sub"].(string)
+	for _, scope := range scopesForPath(reportPath) {
+		for _, rule := range settings.Rules {
+			if !claimMatches(claims[rule.Claim], rule.Value) {
+				continue
+			}
+			for _, ruleScope := range rule.Scopes {
+				if ruleScope == scope {
+					usedKey = fmt.Sprintf(
+						"token for %s (%s=%s, %s)",
+						subject,
+						rule.Claim,
+						rule.Value,
+						scope,
+					)
+					return true, usedKey, nil
+				}
+			}
+		}
+	}
+	return false, "", nil
+}
+
+// a claim can be a single value or a list
+func claimMatches(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, item := range claim {
+			if claimMatches(item, value) {
+				return true
+			}
+		}
+		return false
+	case string:
+		return value == "" || claim == value
+	default:
+		return value == "" || fmt.Sprint(claim) == value
+	}
+}
+
+// check the signature, issuer, audience, and times of a JWT and return
+// it's claims
+func verifyJWT(token string, settings jwtSettings, configPath string) (
+	claims map[string]interface{},
+	err error,
+) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("a JWT has 3 parts")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("the signature is not valid base64")
+	}
+
+	key, err := jwtKey(settings, configPath, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(
+		header.Alg,
+		key,
+		[]byte(parts[0]+"."+parts[1]),
+		signature,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if issuer, _ := claims["iss"].(string); issuer != settings.Issuer {
+		return nil, errors.New("the token is from the wrong issuer")
+	}
+	if settings.Audience != "" &&
+		!claimMatches(claims["aud"], settings.Audience) {
+		return nil, errors.New("the token is for a different audience")
+	}
+	now := time.Now()
+	exp, hasExp := claims["exp"].(float64)
+	if !hasExp {
+		return nil, errors.New("the token does not expire")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("the token has expired")
+	}
+	if nbf, hasNbf := claims["nbf"].(float64); hasNbf &&
+		now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("the token is not valid yet")
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	partJSON, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("the token is not valid base64")
+	}
+	err = json.Unmarshal(partJSON, v)
+	if err != nil {
+		return errors.New("the token is not valid JSON")
+	}
+	return nil
+}
+
+// we only accept asymmetric algorithms. "none" and HMAC make no sense when
+// the key comes from a JWKS.
+func verifyJWTSignature(
+	alg string,
+	key crypto.PublicKey,
+	signed []byte,
+	signature []byte,
+) error {
+	if len(alg) != 5 {
+		return errors.New("unsupported algorithm " + alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errors.New("unsupported algorithm " + alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	badSignature := errors.New("the signature is not valid")
+	switch alg[:2] {
+	case "RS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("the key does not match the algorithm")
+		}
+		if rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature) != nil {
+			return badSignature
+		}
+	case "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("the key does not match the algorithm")
+		}
+		if rsa.VerifyPSS(rsaKey, hash, digest, signature, nil) != nil {
+			return badSignature
+		}
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("the key does not match the algorithm")
+		}
+		// the signature is r and s, each padded to the size of the curve
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return badSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return badSignature
+		}
+	default:
+		return errors.New("unsupported algorithm " + alg)
+	}
+	return nil
+}
+
+// a key from a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("the key is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, errors.New("unsupported key type " + jwk.Kty)
+	}
+}
+
+// find the key a token was signed with
+func jwtKey(settings jwtSettings, configPath string, kid string) (
+	crypto.PublicKey,
+	error,
+) {
+	var jwksJSON []byte
+	if settings.JWKSFile != "" {
+		// relative paths are relative to config.json
+		jwksFile := settings.JWKSFile
+		if !filepath.IsAbs(jwksFile) {
+			jwksFile = filepath.Join(filepath.Dir(configPath), jwksFile)
+		}
+		var err error
+		jwksJSON, err = ioutil.ReadFile(jwksFile)
+		jgh.PanicOnErr(err)
+	} else {
+		jwksJSON = fetchJWKS(settings.JWKSURL, false)
+	}
+
+	key, err := findJWK(jwksJSON, kid)
+	if err != nil && settings.JWKSURL != "" {
+		// the identity provider may have rotated it's keys
+		key, err = findJWK(fetchJWKS(settings.JWKSURL, true), kid)
+	}
+	return key, err
+}
+
+func findJWK(jwksJSON []byte, kid string) (crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(jwksJSON, &jwks)
+	jgh.PanicOnErr(err)
+
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// if the token doesn't say which key, and there is only 1
+		// key, use that one
+		if jwk.Kid == kid || kid == "" && len(jwks.Keys) == 1 {
+			return jwk.publicKey()
+		}
+	}
+	return nil, errors.New("the token was signed with a key we don't know")
+}
+
+// a JWKS is a few keys. Anything much bigger than this is not a JWKS.
+const maxJWKSSize = 1 << 20
+
+// get a JWKS from a URL. We keep a copy in the database so CGI doesn't
+// have to fetch it for every request. If refresh is set, we fetch it again
+// unless we just did.
+func fetchJWKS(url string, refresh bool) (jwksJSON []byte) {
+	fresh := false
+	withDatabase(func(db *sql.DB) {
+		createJWKSTable(db)
+
+		var body string
+		var fetched int64
+		row := db.QueryRow("SELECT body, fetched FROM jwks WHERE url = ?", url)
+		err := row.Scan(&body, &fetched)
+		if err == sql.ErrNoRows {
+			return
+		}
+		jgh.PanicOnErr(err)
+		age := time.Since(time.Unix(fetched, 0))
+		if age < jwksMinAge || !refresh && age < jwksMaxAge {
+			jwksJSON = []byte(body)
+			fresh = true
+		}
+	})
+	if fresh {
+		return
+	}
+
+	// this is done outside of withDatabase, which would retry a failed
+	// fetch and hold the database open while we wait
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(url)
+	jgh.PanicOnErr(err)
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		panic("502 Could not get the JWKS: " + response.Status)
+	}
+	jwksJSON, err = ioutil.ReadAll(io.LimitReader(response.Body, maxJWKSSize+1))
+	jgh.PanicOnErr(err)
+	if len(jwksJSON) > maxJWKSSize {
+		panic("502 The JWKS is too big")
+	}
+
+	withDatabase(func(db *sql.DB) {
+		createJWKSTable(db)
+
+		_, err := db.Exec(`
+			INSERT OR REPLACE INTO jwks (url, body, fetched)
+			VALUES (?, ?, ?)
+		`, url, string(jwksJSON), time.Now().Unix())
+		jgh.PanicOnErr(err)
+	})
+	return
+}
+
+func createJWKSTable(db *sql.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS jwks (
+			url TEXT PRIMARY KEY,
+			body TEXT NOT NULL,
+			fetched INTEGER NOT NULL
+		)
+	`)
+	jgh.PanicOnErr(err)
+}
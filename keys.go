@@ -0,0 +1,960 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// a report password as it is kept in the database. We only keep hashes.
+// When a password is rotated, the old one keeps working until OldExpires.
+// A password can cover several scopes. A scope is either the path of 1
+// report, or a folder ending in "/*" (ex: esp/bentonvisms/public/*).
+type storedPassword struct {
+	keyMetadata
+	ID           string
+	Scopes       []string
+	Hash         string
+	OldHash      string
+	OldExpires   time.Time
+	Created      time.Time
+	LastUsed     time.Time
+	LastUsedFrom string
+	// the HMAC key for pseudonymized columns. Each password has it's own
+	// so 2 vendors can't match up rows by pseudonym.
+	PseudonymKey string
+	// the scope that matched the request, if we looked this up by path
+	Scope string
+}
+
+// settings for a password that can be changed after it is created.
+// Expires is the zero time if the password does not expire. If AllowedIPs
+// is empty the password can be used from anywhere. Prompts limits the
+// answers that can be given to prompts (see applyPinnedPrompts). Columns
+// maps column names to how they are redacted (see redactColumns). If
+// AllowedOrigins is empty the password can be used from any web page that
+// config.json allows.
+type keyMetadata struct {
+	Owner          string
+	Description    string
+	Expires        time.Time
+	AllowedIPs     []string
+	AllowedOrigins []string
+	Prompts        map[string][]string
+	Columns        map[string]string
+}
+
+// what a password limits the person using it to. The zero value doesn't
+// limit anything (for the master password and bearer tokens).
+type keyRestrictions struct {
+	Origins      []string
+	Prompts      map[string][]string
+	Columns      map[string]string
+	PseudonymKey string
+}
+
+// what the key management API tells you about a report password. We only
+// keep hashes, so Password is only filled in when a password is created.
+type keyInfo struct {
+	ID             string              `json:"id"`
+	Scopes         []string            `json:"scopes"`
+	Password       string              `json:"password,omitempty"`
+	Owner          string              `json:"owner"`
+	Description    string              `json:"description"`
+	Created        time.Time           `json:"created"`
+	Expires        *time.Time          `json:"expires,omitempty"`
+	Expired        bool                `json:"expired,omitempty"`
+	AllowedIPs     []string            `json:"allowedIPs,omitempty"`
+	AllowedOrigins []string            `json:"allowedOrigins,omitempty"`
+	Prompts        map[string][]string `json:"prompts,omitempty"`
+	Columns        map[string]string   `json:"columns,omitempty"`
+	LastUsed       *time.Time          `json:"lastUsed,omitempty"`
+	LastUsedFrom   string              `json:"lastUsedFrom,omitempty"`
+	OldPasswordEnd *time.Time          `json:"oldPasswordExpires,omitempty"`
+}
+
+// anything we can run a query on
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func createPasswordsTable(db *sql.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS passwords (
+			id TEXT PRIMARY KEY,
+			hash TEXT NOT NULL,
+			oldHash TEXT NOT NULL DEFAULT '',
+			oldExpires INTEGER NOT NULL DEFAULT 0,
+			created INTEGER NOT NULL,
+			owner TEXT NOT NULL DEFAULT '',
+			description TEXT NOT NULL DEFAULT '',
+			expires INTEGER NOT NULL DEFAULT 0,
+			lastUsed INTEGER NOT NULL DEFAULT 0,
+			lastUsedFrom TEXT NOT NULL DEFAULT '',
+			allowedIPs TEXT NOT NULL DEFAULT '',
+			allowedOrigins TEXT NOT NULL DEFAULT '',
+			prompts TEXT NOT NULL DEFAULT '',
+			columns TEXT NOT NULL DEFAULT '',
+			pseudonymKey TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	jgh.PanicOnErr(err)
+	// older versions didn't have these
+	addColumn(db, "passwords", "owner", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "passwords", "description", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "passwords", "expires", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "passwords", "lastUsed", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "passwords", "lastUsedFrom", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "passwords", "allowedIPs", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "passwords", "allowedOrigins", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "passwords", "prompts", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "passwords", "columns", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "passwords", "pseudonymKey", "TEXT NOT NULL DEFAULT ''")
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS passwordScopes (
+			id TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			PRIMARY KEY (id, scope)
+		)
+	`)
+	jgh.PanicOnErr(err)
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS passwordScopesByScope
+		ON passwordScopes (scope)
+	`)
+	jgh.PanicOnErr(err)
+	// paths we have already imported from config.json, so a password
+	// that was revoked doesn't come back
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS importedPasswords (
+			path TEXT PRIMARY KEY
+		)
+	`)
+	jgh.PanicOnErr(err)
+
+	migrateReportPasswords(db)
+}
+
+// we used to have 1 password per report in a table called
+// reportPasswords. Each of those becomes a password with 1 scope.
+func migrateReportPasswords(db *sql.DB) {
+	var oldTables int
+	row := db.QueryRow(`
+		SELECT COUNT(*)
+		FROM sqlite_master
+		WHERE type = 'table' AND name = 'reportPasswords'
+	`)
+	err := row.Scan(&oldTables)
+	jgh.PanicOnErr(err)
+	if oldTables == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	jgh.PanicOnErr(err)
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT path, hash, oldHash, oldExpires, created
+		FROM reportPasswords
+	`)
+	jgh.PanicOnErr(err)
+	var oldPasswords []storedPassword
+	for rows.Next() {
+		var stored storedPassword
+		var oldExpires, created int64
+		err = rows.Scan(
+			&stored.Scope,
+			&stored.Hash,
+			&stored.OldHash,
+			&oldExpires,
+			&created,
+		)
+		jgh.PanicOnErr(err)
+		stored.OldExpires = time.Unix(oldExpires, 0)
+		stored.Created = time.Unix(created, 0)
+		oldPasswords = append(oldPasswords, stored)
+	}
+	err = rows.Err()
+	rows.Close()
+	jgh.PanicOnErr(err)
+
+	for _, stored := range oldPasswords {
+		id := insertPassword(tx, []string{stored.Scope}, stored.Hash, keyMetadata{})
+		_, err = tx.Exec(`
+			UPDATE passwords
+			SET oldHash = ?, oldExpires = ?, created = ?
+			WHERE id = ?
+		`, stored.OldHash, stored.OldExpires.Unix(), stored.Created.Unix(), id)
+		jgh.PanicOnErr(err)
+	}
+	_, err = tx.Exec("DROP TABLE reportPasswords")
+	jgh.PanicOnErr(err)
+
+	err = tx.Commit()
+	jgh.PanicOnErr(err)
+}
+
+// the scopes that would cover a report, most specific first
+func scopesForPath(path []string) []string {
+	scopes := []string{pathToString(path)}
+	for i := len(path) - 1; i >= 0; i-- {
+		scopes = append(scopes, pathToString(append(path[:i:i], "*")))
+	}
+	return scopes
+}
+
+// a scope is a report path, or a folder path ending in "/*"
+func validateScope(scope string) {
+	parts := strings.Split(scope, "/")
+	for i, part := range parts {
+		if part == "" {
+			panic("400 A scope may not have empty path components")
+		}
+		if strings.Contains(part, "*") && (part != "*" || i != len(parts)-1) {
+			panic("400 * may only be used as the last part of a scope")
+		}
+	}
+}
+
+// check a password against the current and old hashes
+func (stored storedPassword) check(providedPassword string) bool {
+	if checkReportPassword(stored.Hash, providedPassword) {
+		return true
+	}
+	return stored.OldHash != "" &&
+		time.Now().Before(stored.OldExpires) &&
+		checkReportPassword(stored.OldHash, providedPassword)
+}
+
+// check if a password can be used from an IP address
+func (stored storedPassword) allowedFrom(remoteIP string) bool {
+	return len(stored.AllowedIPs) == 0 || ipInRanges(remoteIP, stored.AllowedIPs)
+}
+
+// a password can't be used after it expires
+func (stored storedPassword) expired() bool {
+	return !stored.Expires.IsZero() && !time.Now().Before(stored.Expires)
+}
+
+func (stored storedPassword) info() keyInfo {
+	key := keyInfo{
+		ID:             stored.ID,
+		Scopes:         stored.Scopes,
+		Owner:          stored.Owner,
+		Description:    stored.Description,
+		Created:        stored.Created,
+		Expired:        stored.expired(),
+		AllowedIPs:     stored.AllowedIPs,
+		AllowedOrigins: stored.AllowedOrigins,
+		Prompts:        stored.Prompts,
+		Columns:        stored.Columns,
+		LastUsedFrom:   stored.LastUsedFrom,
+	}
+	if !stored.Expires.IsZero() {
+		expires := stored.Expires
+		key.Expires = &expires
+	}
+	if !stored.LastUsed.IsZero() {
+		lastUsed := stored.LastUsed
+		key.LastUsed = &lastUsed
+	}
+	if stored.OldHash != "" && time.Now().Before(stored.OldExpires) {
+		oldExpires := stored.OldExpires
+		key.OldPasswordEnd = &oldExpires
+	}
+	return key
+}
+
+// the columns scanStoredPassword expects
+const storedPasswordColumns = `
+	passwords.id,
+	passwords.hash,
+	passwords.oldHash,
+	passwords.oldExpires,
+	passwords.created,
+	passwords.owner,
+	passwords.description,
+	passwords.expires,
+	passwords.lastUsed,
+	passwords.lastUsedFrom,
+	passwords.allowedIPs,
+	passwords.allowedOrigins,
+	passwords.prompts,
+	passwords.columns,
+	passwords.pseudonymKey
+`
+
+func scanStoredPassword(row interface{ Scan(...interface{}) error }) (
+	stored storedPassword,
+	err error,
+) {
+	var oldExpires, created, expires, lastUsed int64
+	var allowedIPs, allowedOrigins, prompts, columns string
+	err = row.Scan(
+		&stored.ID,
+		&stored.Hash,
+		&stored.OldHash,
+		&oldExpires,
+		&created,
+		&stored.Owner,
+		&stored.Description,
+		&expires,
+		&lastUsed,
+		&stored.LastUsedFrom,
+		&allowedIPs,
+		&allowedOrigins,
+		&prompts,
+		&columns,
+		&stored.PseudonymKey,
+	)
+	if err != nil {
+		return
+	}
+	if allowedIPs != "" {
+		stored.AllowedIPs = strings.Split(allowedIPs, ",")
+	}
+	if allowedOrigins != "" {
+		stored.AllowedOrigins = strings.Split(allowedOrigins, ",")
+	}
+	if prompts != "" {
+		err = json.Unmarshal([]byte(prompts), &stored.Prompts)
+		if err != nil {
+			return
+		}
+	}
+	if columns != "" {
+		err = json.Unmarshal([]byte(columns), &stored.Columns)
+	}
+	stored.OldExpires = time.Unix(oldExpires, 0)
+	stored.Created = time.Unix(created, 0)
+	// 0 means never
+	if expires != 0 {
+		stored.Expires = time.Unix(expires, 0)
+	}
+	if lastUsed != 0 {
+		stored.LastUsed = time.Unix(lastUsed, 0)
+	}
+	return
+}
+
+// a time in the database, where 0 means never
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// look up a password and it's scopes by ID
+func lookupPassword(db queryer, id string) (stored storedPassword, exists bool) {
+	row := db.QueryRow(`
+		SELECT `+storedPasswordColumns+`
+		FROM passwords
+		WHERE id = ?
+	`, id)
+	stored, err := scanStoredPassword(row)
+	if err == sql.ErrNoRows {
+		return stored, false
+	}
+	jgh.PanicOnErr(err)
+
+	rows, err := db.Query(`
+		SELECT scope
+		FROM passwordScopes
+		WHERE id = ?
+		ORDER BY scope
+	`, id)
+	jgh.PanicOnErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var scope string
+		err = rows.Scan(&scope)
+		jgh.PanicOnErr(err)
+		stored.Scopes = append(stored.Scopes, scope)
+	}
+	jgh.PanicOnErr(rows.Err())
+	return stored, true
+}
+
+// all the passwords that cover a report, most specific first
+func passwordsForPath(path []string) (matches []storedPassword) {
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		matches = nil
+		for _, scope := range scopesForPath(path) {
+			rows, err := db.Query(`
+				SELECT `+storedPasswordColumns+`
+				FROM passwords
+				JOIN passwordScopes ON passwords.id = passwordScopes.id
+				WHERE passwordScopes.scope = ?
+				ORDER BY passwords.created DESC
+			`, scope)
+			jgh.PanicOnErr(err)
+			for rows.Next() {
+				stored, err := scanStoredPassword(rows)
+				jgh.PanicOnErr(err)
+				stored.Scope = scope
+				matches = append(matches, stored)
+			}
+			err = rows.Err()
+			rows.Close()
+			jgh.PanicOnErr(err)
+		}
+	})
+	return
+}
+
+// add a password to the database as part of a transaction
+func insertPassword(
+	tx *sql.Tx,
+	scopes []string,
+	hash string,
+	meta keyMetadata,
+) (id string) {
+	id = jgh.RandomString(16)
+	_, err := tx.Exec(`
+		INSERT INTO passwords
+			(id, hash, created, owner, description, expires, allowedIPs,
+				allowedOrigins, prompts, columns, pseudonymKey)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		id,
+		hash,
+		time.Now().Unix(),
+		meta.Owner,
+		meta.Description,
+		unixOrZero(meta.Expires),
+		strings.Join(meta.AllowedIPs, ","),
+		strings.Join(meta.AllowedOrigins, ","),
+		jsonColumn(meta.Prompts),
+		jsonColumn(meta.Columns),
+		jgh.RandomString(32),
+	)
+	jgh.PanicOnErr(err)
+	for _, scope := range scopes {
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO passwordScopes (id, scope) VALUES (?, ?)",
+			id,
+			scope,
+		)
+		jgh.PanicOnErr(err)
+	}
+	return
+}
+
+// create a password that covers some scopes
+func createPassword(scopes []string, meta keyMetadata) (key keyInfo) {
+	if len(scopes) == 0 {
+		panic("400 A password must have at least 1 scope")
+	}
+	for _, scope := range scopes {
+		validateScope(scope)
+	}
+
+	// we only keep a hash, so this is the only time anyone sees it
+	password := jgh.RandomString(64)
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+		id := insertPassword(tx, scopes, hashReportPassword(password), meta)
+		stored, _ := lookupPassword(tx, id)
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+
+		key = stored.info()
+	})
+	key.Password = password
+	return
+}
+
+// move passwords from an old config.json into the database. Each path is
+// only imported once.
+func importReportPasswords(passwords map[string]string) {
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		for pathString, password := range passwords {
+			result, err := tx.Exec(
+				"INSERT OR IGNORE INTO importedPasswords (path) VALUES (?)",
+				pathString,
+			)
+			jgh.PanicOnErr(err)
+			rows, err := result.RowsAffected()
+			jgh.PanicOnErr(err)
+			if rows == 0 {
+				continue
+			}
+
+			// older versions stored plaintext passwords
+			if !strings.HasPrefix(password, reportPasswordHashPrefix) {
+				password = hashReportPassword(password)
+			}
+			insertPassword(tx, []string{pathString}, password, keyMetadata{
+				Description: "Imported from config.json",
+			})
+		}
+
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+	})
+}
+
+// check for the master password. Like AllowedAccess, this has a minimum
+// execution time of 100ms to guard against timeing attacks
+func isMasterPassword(providedPassword string) bool {
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go func() {
+		time.Sleep(time.Millisecond * minMsForPasswordCheck)
+		waitGroup.Done()
+	}()
+
+	config.mutex.Lock()
+	masterPassword := config.MasterPassword
+	config.mutex.Unlock()
+	isMaster := checkMasterPassword(masterPassword, providedPassword)
+
+	waitGroup.Wait()
+	return isMaster
+}
+
+// list all report passwords in the order they were created
+func listReportPasswords() (keys []keyInfo) {
+	keys = make([]keyInfo, 0)
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		rows, err := db.Query("SELECT id FROM passwords ORDER BY created, id")
+		jgh.PanicOnErr(err)
+		var ids []string
+		for rows.Next() {
+			var id string
+			err = rows.Scan(&id)
+			jgh.PanicOnErr(err)
+			ids = append(ids, id)
+		}
+		err = rows.Err()
+		rows.Close()
+		jgh.PanicOnErr(err)
+
+		keys = keys[:0]
+		for _, id := range ids {
+			stored, _ := lookupPassword(db, id)
+			keys = append(keys, stored.info())
+		}
+	})
+	return
+}
+
+// replace a password. The old password keeps working for grace seconds.
+// Only 1 old password is kept.
+func rotateReportPassword(id string, grace uint) (key keyInfo) {
+	newPassword := jgh.RandomString(64)
+	// withDatabase retries anything that panics, so we don't panic until
+	// we are out of it
+	var exists bool
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		var stored storedPassword
+		stored, exists = lookupPassword(tx, id)
+		if !exists {
+			return
+		}
+
+		stored.OldHash = ""
+		stored.OldExpires = time.Unix(0, 0)
+		if grace > 0 {
+			stored.OldHash = stored.Hash
+			oldExpires := time.Now().Add(time.Duration(grace) * time.Second)
+			// the database only keeps whole seconds
+			stored.OldExpires = time.Unix(oldExpires.Unix(), 0)
+		}
+		stored.Hash = hashReportPassword(newPassword)
+		_, err = tx.Exec(`
+			UPDATE passwords
+			SET hash = ?, oldHash = ?, oldExpires = ?
+			WHERE id = ?
+		`, stored.Hash, stored.OldHash, stored.OldExpires.Unix(), id)
+		jgh.PanicOnErr(err)
+
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+		key = stored.info()
+	})
+	if !exists {
+		panic("404 There is no report password with that ID")
+	}
+	key.Password = newPassword
+	return
+}
+
+// remove a password, including any old password that is still in it's
+// grace period
+func revokeReportPassword(id string) {
+	var exists bool
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		result, err := tx.Exec("DELETE FROM passwords WHERE id = ?", id)
+		jgh.PanicOnErr(err)
+		rows, err := result.RowsAffected()
+		jgh.PanicOnErr(err)
+		exists = rows > 0
+		if !exists {
+			return
+		}
+		_, err = tx.Exec("DELETE FROM passwordScopes WHERE id = ?", id)
+		jgh.PanicOnErr(err)
+
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+	})
+	if !exists {
+		panic("404 There is no report password with that ID")
+	}
+}
+
+// change the metadata of a password. Only the values that are given are
+// changed.
+func updatePasswordMetadata(id string, values map[string]string) (key keyInfo) {
+	// check the values before we get to the database, since withDatabase
+	// retries anything that panics
+	parseKeyMetadata(values, keyMetadata{})
+
+	var exists bool
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		var stored storedPassword
+		stored, exists = lookupPassword(tx, id)
+		if !exists {
+			return
+		}
+		stored.keyMetadata = parseKeyMetadata(values, stored.keyMetadata)
+		// passwords from older versions don't have a pseudonym key
+		if stored.PseudonymKey == "" {
+			stored.PseudonymKey = jgh.RandomString(32)
+		}
+		_, err = tx.Exec(`
+			UPDATE passwords
+			SET owner = ?, description = ?, expires = ?, allowedIPs = ?,
+				allowedOrigins = ?, prompts = ?, columns = ?, pseudonymKey = ?
+			WHERE id = ?
+		`,
+			stored.Owner,
+			stored.Description,
+			unixOrZero(stored.Expires),
+			strings.Join(stored.AllowedIPs, ","),
+			strings.Join(stored.AllowedOrigins, ","),
+			jsonColumn(stored.Prompts),
+			jsonColumn(stored.Columns),
+			stored.PseudonymKey,
+			id,
+		)
+		jgh.PanicOnErr(err)
+
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+		key = stored.info()
+	})
+	if !exists {
+		panic("404 There is no report password with that ID")
+	}
+	return
+}
+
+// remember when and where a password was last used
+func recordPasswordUse(id string, remoteIP string) {
+	withDatabase(func(db *sql.DB) {
+		createPasswordsTable(db)
+
+		_, err := db.Exec(`
+			UPDATE passwords
+			SET lastUsed = ?, lastUsedFrom = ?
+			WHERE id = ?
+		`, time.Now().Unix(), remoteIP, id)
+		jgh.PanicOnErr(err)
+	})
+}
+
+// read owner, description, expires, allowedIPs, allowedOrigins, prompts,
+// and columns from request values. expires can be a date (2006-01-02), an
+// RFC 3339 time, or "never". allowedIPs is a comma separated list of IP
+// addresses and CIDR ranges. allowedOrigins is a comma separated list of
+// origins (ex: https://dashboard.example.com). prompts is a JSON object of
+// prompt names to lists of allowed answers. columns is a JSON object of
+// column names to "drop", "mask", or "pseudonymize".
+func parseKeyMetadata(values map[string]string, meta keyMetadata) keyMetadata {
+	if owner, exists := values["owner"]; exists {
+		meta.Owner = owner
+	}
+	if description, exists := values["description"]; exists {
+		meta.Description = description
+	}
+	if expires, exists := values["expires"]; exists {
+		if expires == "" || expires == "never" {
+			meta.Expires = time.Time{}
+		} else {
+			meta.Expires = parseDateOrTime("expires", expires)
+		}
+	}
+	if allowedIPs, exists := values["allowedIPs"]; exists {
+		meta.AllowedIPs = nil
+		for _, ipRange := range strings.Split(allowedIPs, ",") {
+			ipRange = strings.TrimSpace(ipRange)
+			if ipRange == "" {
+				continue
+			}
+			if parseIPRange(ipRange) == nil {
+				panic("400 " + ipRange + " is not an IP address or CIDR range")
+			}
+			meta.AllowedIPs = append(meta.AllowedIPs, ipRange)
+		}
+	}
+	if allowedOrigins, exists := values["allowedOrigins"]; exists {
+		meta.AllowedOrigins = nil
+		for _, origin := range strings.Split(allowedOrigins, ",") {
+			origin = strings.TrimSpace(origin)
+			if origin == "" {
+				continue
+			}
+			if !validOrigin(origin) {
+				panic("400 " + origin + " is not an origin like https://example.com")
+			}
+			meta.AllowedOrigins = append(meta.AllowedOrigins, origin)
+		}
+	}
+	if prompts, exists := values["prompts"]; exists {
+		meta.Prompts = nil
+		if prompts != "" {
+			err := json.Unmarshal([]byte(prompts), &meta.Prompts)
+			if err != nil {
+				panic(`400 prompts must be a JSON object like ` +
+					`{"Building Parameter": ["8"]}`)
+			}
+		}
+		for name, answers := range meta.Prompts {
+			if len(answers) == 0 {
+				panic("400 prompts must list at least 1 answer for " + name)
+			}
+		}
+	}
+	if columns, exists := values["columns"]; exists {
+		meta.Columns = nil
+		if columns != "" {
+			err := json.Unmarshal([]byte(columns), &meta.Columns)
+			if err != nil {
+				panic(`400 columns must be a JSON object like {"SSN": "drop"}`)
+			}
+		}
+		for name, rule := range meta.Columns {
+			if rule != redactDrop && rule != redactMask && rule != redactPseudonymize {
+				panic("400 " + name + " must be drop, mask, or pseudonymize")
+			}
+		}
+	}
+	return meta
+}
+
+// parse a date (2006-01-02, in local time) or an RFC 3339 time from a
+// request. name is used in the error message.
+func parseDateOrTime(name string, value string) time.Time {
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
+	}
+	panic("400 " + name + " must be a date like 2006-01-02 or " +
+		"a time like 2006-01-02T15:04:05Z")
+}
+
+// pinned prompts and column rules are stored as JSON, or "" if there are
+// none
+func jsonColumn(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	jgh.PanicOnErr(err)
+	if string(encoded) == "null" || string(encoded) == "{}" {
+		return ""
+	}
+	return string(encoded)
+}
+
+func (stored storedPassword) restrictions() keyRestrictions {
+	return keyRestrictions{
+		Origins:      stored.AllowedOrigins,
+		Prompts:      stored.Prompts,
+		Columns:      stored.Columns,
+		PseudonymKey: stored.PseudonymKey,
+	}
+}
+
+// fill in prompts that a password only allows 1 answer for, then make sure
+// the rest of the prompt answers are allowed. This lets one report serve
+// several buildings without a password for 1 building being able to see
+// the others.
+func applyPinnedPrompts(pinned map[string][]string, promptAnswers map[string]string) {
+	for name, allowed := range pinned {
+		if _, given := promptAnswers[name]; !given && len(allowed) == 1 {
+			promptAnswers[name] = allowed[0]
+		}
+	}
+	checkPinnedPrompts(pinned, promptAnswers)
+}
+
+// make sure every pinned prompt was answered with an allowed answer
+func checkPinnedPrompts(pinned map[string][]string, promptAnswers map[string]string) {
+	for name, allowed := range pinned {
+		answer, given := promptAnswers[name]
+		if !given {
+			panic("403 Forbidden: This report password requires an answer " +
+				"for " + name + " (one of " + strings.Join(allowed, ", ") + ")")
+		}
+		ok := false
+		for _, a := range allowed {
+			if answer == a {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			panic("403 Forbidden: This report password can't use " +
+				answer + " for " + name)
+		}
+	}
+}
+
+// the key management API. path has already had "keys" removed. All of
+// these require the master password.
+//   - GET /keys lists report passwords
+//   - POST /keys/{report path} creates a password for 1 report. The path can
+//     end in "/*" to cover a whole folder. "owner", "description",
+//     "expires", "allowedIPs", "allowedOrigins", "prompts", and "columns"
+//     can be sent with this and with POST /keys.
+//   - POST /keys with "scopes" (a JSON list of paths) in the body creates a
+//     password for several reports or folders
+//   - PATCH /keys/{id} changes any of the values that can be sent when a
+//     password is created
+//   - PUT /keys/{id} rotates a password. Send "grace" (in seconds) to keep
+//     the old one working for a while.
+//   - DELETE /keys/{id} revokes a password
+func handleKeysRequest(
+	response http.ResponseWriter,
+	request *http.Request,
+	providedPassword string,
+	path []string,
+) {
+	if !isMasterPassword(providedPassword) {
+		response.Header().Set("WWW-Authenticate", `Basic realm="Carl Sagan"`)
+		response.Header().Set("Content-Type", "text/plain")
+		response.WriteHeader(401)
+		_, err := response.Write([]byte("Unauthorised: Managing report " +
+			"passwords requires the master password\n"))
+		jgh.PanicOnErr(err)
+		return
+	}
+
+	// ParsePath gives us [""] for the root
+	if len(path) == 1 && path[0] == "" {
+		path = nil
+	}
+
+	var result interface{}
+	status := 200
+	switch {
+	case request.Method == "GET" && len(path) == 0:
+		result = listReportPasswords()
+	case request.Method == "POST" && len(path) == 0:
+		var body struct {
+			Scopes         []string            `json:"scopes"`
+			Owner          string              `json:"owner"`
+			Description    string              `json:"description"`
+			Expires        string              `json:"expires"`
+			AllowedIPs     []string            `json:"allowedIPs"`
+			AllowedOrigins []string            `json:"allowedOrigins"`
+			Prompts        map[string][]string `json:"prompts"`
+			Columns        map[string]string   `json:"columns"`
+		}
+		err := json.NewDecoder(request.Body).Decode(&body)
+		if err != nil {
+			panic(`400 Send a JSON body like {"scopes": ["esp/bentonvisms/public/*"]}`)
+		}
+		meta := parseKeyMetadata(map[string]string{
+			"owner":          body.Owner,
+			"description":    body.Description,
+			"expires":        body.Expires,
+			"allowedIPs":     strings.Join(body.AllowedIPs, ","),
+			"allowedOrigins": strings.Join(body.AllowedOrigins, ","),
+			"prompts":        jsonColumn(body.Prompts),
+			"columns":        jsonColumn(body.Columns),
+		}, keyMetadata{})
+		result = createPassword(body.Scopes, meta)
+		status = 201
+	case request.Method == "POST" && len(path) > 0:
+		meta := parseKeyMetadata(getFormValues(request), keyMetadata{})
+		result = createPassword([]string{pathToString(path)}, meta)
+		status = 201
+	case request.Method == "PATCH" && len(path) == 1:
+		result = updatePasswordMetadata(path[0], getFormValues(request))
+	case request.Method == "PUT" && len(path) == 1:
+		var grace uint64
+		graceString := getFormValues(request)["grace"]
+		if graceString != "" {
+			var err error
+			grace, err = strconv.ParseUint(graceString, 10, 32)
+			if err != nil {
+				panic("400 grace must be a number of seconds")
+			}
+		}
+		result = rotateReportPassword(path[0], uint(grace))
+	case request.Method == "DELETE" && len(path) == 1:
+		revokeReportPassword(path[0])
+		response.WriteHeader(204)
+		return
+	default:
+		response.Header().Set("Content-Type", "text/plain")
+		response.WriteHeader(404)
+		_, err := response.Write([]byte("Use GET /keys, POST /keys, " +
+			"POST /keys/{report path}, PATCH /keys/{id}, PUT /keys/{id}, " +
+			"or DELETE /keys/{id}\n"))
+		jgh.PanicOnErr(err)
+		return
+	}
+
+	resultJSON, err := json.MarshalIndent(result, "", "\t")
+	jgh.PanicOnErr(err)
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	_, err = response.Write(append(resultJSON, '\n'))
+	jgh.PanicOnErr(err)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/9072997/jgh"
+)
+
+// systemd passes sockets to us starting at this file descriptor
+const systemdFirstFD = 3
+
+// listen on one of
+// * a TCP address ("127.0.0.1:8080" or ":8080")
+// * a Unix domain socket ("unix:/run/carlsagan.sock")
+// * a socket passed to us by systemd socket activation ("systemd")
+func listen(address string) net.Listener {
+	if address == "systemd" {
+		// see sd_listen_fds(3). We only use the first socket.
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		fdCount, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if pid != os.Getpid() || fdCount < 1 {
+			panic("systemd did not pass us a socket")
+		}
+		file := os.NewFile(systemdFirstFD, "systemd socket")
+		listener, err := net.FileListener(file)
+		jgh.PanicOnErr(err)
+		return listener
+	}
+
+	if strings.HasPrefix(address, "unix:") {
+		socketPath := strings.TrimPrefix(address, "unix:")
+
+		// remove the socket left over from the last time we ran, but
+		// don't delete anything that isn't a socket
+		fileInfo, err := os.Lstat(socketPath)
+		if err == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+			err = os.Remove(socketPath)
+			jgh.PanicOnErr(err)
+		}
+
+		listener, err := net.Listen("unix", socketPath)
+		jgh.PanicOnErr(err)
+		// the reverse proxy needs write permission to connect. Put it in
+		// our group if it runs as a different user.
+		err = os.Chmod(socketPath, 0660)
+		jgh.PanicOnErr(err)
+		return listener
+	}
+
+	listener, err := net.Listen("tcp", address)
+	jgh.PanicOnErr(err)
+	return listener
+}
+
+// used by the standalone and FastCGI servers. The CGI server has its own
+// version of this since it needs to load the config for every request.
+func serverHandlerFunc(response http.ResponseWriter, request *http.Request) {
+	// remove the part of the path that belongs to the reverse proxy
+	config.mutex.Lock()
+	urlPrefix := config.URLPrefix
+	config.mutex.Unlock()
+	if urlPrefix != "" {
+		request.URL.Path = strings.TrimPrefix(request.URL.Path, urlPrefix)
+	}
+
+	handlerFunc(response, request)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// after this many failed logins in a row, an IP address is locked out for
+// lockoutDuration seconds
+const defaultLockoutThreshold = 10
+const defaultLockoutDuration = 900
+
+// each failed login waits longer than the last, up to this long
+const maxAuthFailureDelay = 10 * time.Second
+
+// failed logins are kept in the database so they are shared between CGI
+// processes. A subject is "ip " followed by the IP address. App names are
+// not tracked. They are only a label the client picks, so they say nothing
+// about who is guessing, and tracking them on their own would let anyone
+// lock an app out.
+func createAuthFailuresTable(db *sql.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS authFailures (
+			subject TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL,
+			lastFailure INTEGER NOT NULL,
+			lockedUntil INTEGER NOT NULL
+		)
+	`)
+	jgh.PanicOnErr(err)
+}
+
+// the subjects we track failed logins for
+func authSubjects(remoteIP string) []string {
+	return []string{"ip " + remoteIP}
+}
+
+func lockoutSettings() (threshold int, duration int64) {
+	config.mutex.Lock()
+	threshold = config.LockoutThreshold
+	duration = int64(config.LockoutDuration)
+	config.mutex.Unlock()
+	if threshold == 0 {
+		threshold = defaultLockoutThreshold
+	}
+	if duration == 0 {
+		duration = defaultLockoutDuration
+	}
+	return
+}
+
+// check if any of the subjects are locked out. retryAfter is how long until
+// the lockout ends.
+func authLockedOut(subjects []string) (lockedOut bool, retryAfter time.Duration) {
+	threshold, _ := lockoutSettings()
+	if threshold < 0 {
+		return false, 0
+	}
+
+	now := time.Now()
+	withDatabase(func(db *sql.DB) {
+		createAuthFailuresTable(db)
+
+		for _, subject := range subjects {
+			var lockedUntil int64
+			row := db.QueryRow(
+				"SELECT lockedUntil FROM authFailures WHERE subject = ?",
+				subject,
+			)
+			err := row.Scan(&lockedUntil)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			jgh.PanicOnErr(err)
+
+			if now.Unix() < lockedUntil {
+				lockedOut = true
+				wait := time.Unix(lockedUntil, 0).Sub(now)
+				if wait > retryAfter {
+					retryAfter = wait
+				}
+			}
+		}
+	})
+	return
+}
+
+// count a failed login for each subject. This locks out subjects that have
+// failed too many times. delay is how long to wait before telling the
+// client, which grows with each failure.
+func recordAuthFailure(subjects []string) (delay time.Duration) {
+	threshold, duration := lockoutSettings()
+	if threshold < 0 {
+		return 0
+	}
+
+	now := time.Now().Unix()
+	withDatabase(func(db *sql.DB) {
+		createAuthFailuresTable(db)
+
+		tx, err := db.Begin()
+		jgh.PanicOnErr(err)
+		defer tx.Rollback()
+
+		mostFailures := 0
+		for _, subject := range subjects {
+			// start counting again if the last failure was a while ago
+			_, err = tx.Exec(`
+				INSERT INTO authFailures
+					(subject, failures, lastFailure, lockedUntil)
+				VALUES
+					(?, 1, ?, 0)
+				ON CONFLICT (subject) DO UPDATE SET
+					failures = CASE
+						WHEN lastFailure < ? THEN 1
+						ELSE failures + 1
+					END,
+					lastFailure = excluded.lastFailure
+			`, subject, now, now-duration)
+			jgh.PanicOnErr(err)
+
+			var failures int
+			row := tx.QueryRow(
+				"SELECT failures FROM authFailures WHERE subject = ?",
+				subject,
+			)
+			err = row.Scan(&failures)
+			jgh.PanicOnErr(err)
+			if failures >= threshold {
+				_, err = tx.Exec(
+					"UPDATE authFailures SET lockedUntil = ? WHERE subject = ?",
+					now+duration,
+					subject,
+				)
+				jgh.PanicOnErr(err)
+			}
+			if failures > mostFailures {
+				mostFailures = failures
+			}
+		}
+
+		err = tx.Commit()
+		jgh.PanicOnErr(err)
+
+		// 250ms, 500ms, 1s, 2s...
+		delay = 250 * time.Millisecond
+		for i := 1; i < mostFailures && delay < maxAuthFailureDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxAuthFailureDelay {
+			delay = maxAuthFailureDelay
+		}
+	})
+	return
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"math"
 	"mime"
+	"net"
 	"net/http"
 	"net/http/cgi"
+	"net/http/fcgi"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/9072997/jgh"
 )
@@ -62,25 +70,40 @@ func getFormValues(request *http.Request) map[string]string {
 }
 
 func handlerFunc(response http.ResponseWriter, request *http.Request) {
+	// requests for report data go in the audit log, along with the status
+	// we sent
+	recorder := &statusRecorder{ResponseWriter: response}
+	response = recorder
+	var access *auditEntry
+	// failed logins are counted for these (see recordAuthFailure)
+	var loginSubjects []string
+
 	// if we panic, return a 500 and log error
 	success, errorMessage := jgh.Try(0, 1, false, "", func() bool {
-		// If this is a CORS preflight request, send back appropriate
-		// headers rather than processing the request normally
+		// everything is protected by authentication, but we only let
+		// web pages from allowed origins use us (see setCORSHeaders)
+		setCORSHeaders(response, request)
+		checkOrigin(request)
+
+		// If this is a CORS preflight request, we just send the headers
+		// rather than processing the request normally
 		if request.Method == "OPTIONS" {
-			origin := request.Header.Get("Origin")
-			response.Header().Set("Access-Control-Allow-Origin", origin)
-			response.Header().Set("Access-Control-Allow-Methods", "*")
-			response.Header().Set("Access-Control-Allow-Headers", "X-API-Key")
 			return true
 		}
 
-		// everything is protected by authentication so CORS is fine
-		response.Header().Set("Access-Control-Allow-Origin", "*")
-
 		// we use the username field for the name of the application.
 		// This is optional, but it's used for logging.
 		appName, password, providedAuth := request.BasicAuth()
 
+		// this is filled in as we learn more about the request
+		access = &auditEntry{
+			Time:     time.Now(),
+			AppName:  appName,
+			ClientIP: clientIP(request),
+			Path:     strings.Trim(request.URL.Path, "/"),
+			Rows:     -1,
+		}
+
 		// If a password was provided via the custom header, prefer that
 		// one over the one from basic-auth
 		apiKeyHeader := request.Header.Get("X-API-Key")
@@ -89,6 +112,15 @@ func handlerFunc(response http.ResponseWriter, request *http.Request) {
 			providedAuth = true
 		}
 
+		// tokens from an identity provider can be used instead of a
+		// password
+		var bearerToken string
+		authorization := request.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") {
+			bearerToken = strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+			providedAuth = true
+		}
+
 		if !providedAuth {
 			response.Header().Set("WWW-Authenticate", `Basic realm="Carl Sagan"`)
 			response.Header().Set("Content-Type", "text/plain")
@@ -100,6 +132,24 @@ func handlerFunc(response http.ResponseWriter, request *http.Request) {
 			return true
 		}
 
+		// too many failed logins locks out an IP address for a while. This includes the right password, so guessing can't
+		// continue. Bearer tokens can't be guessed.
+		if bearerToken == "" {
+			loginSubjects = authSubjects(access.ClientIP)
+			lockedOut, retryAfter := authLockedOut(loginSubjects)
+			if lockedOut {
+				log.Println("Locked out request from", access.ClientIP, appName)
+				seconds := int64(retryAfter/time.Second) + 1
+				response.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+				response.Header().Set("Content-Type", "text/plain")
+				response.WriteHeader(429)
+				_, err := response.Write([]byte("Too many failed logins. " +
+					"Try again later.\n"))
+				jgh.PanicOnErr(err)
+				return true
+			}
+		}
+
 		if !runningAsCGI {
 			log.Println("Request for", request.URL.Path, "from", appName)
 		}
@@ -122,8 +172,115 @@ func handlerFunc(response http.ResponseWriter, request *http.Request) {
 			path[lastPathPos] = strings.TrimSuffix(path[lastPathPos], ".json")
 		}
 
+		// paths starting with "keys" are for managing report passwords
+		if path[0] == "keys" {
+			access = nil
+			handleKeysRequest(response, request, password, path[1:])
+			return true
+		}
+
+		// the health of our Cognos users can be checked with the master
+		// password
+		if path[0] == "credentials" && len(path) == 1 {
+			access = nil
+			handleCredentialsRequest(response, request, password)
+			return true
+		}
+
+		// the audit log can be searched with the master password
+		if path[0] == "audit" && len(path) == 1 {
+			access = nil
+			handleAuditRequest(response, request, password)
+			return true
+		}
+
+		// paths starting with "jobs" are for the asynchronous job API. A
+		// report can also be run as a job by sending a
+		// "Prefer: respond-async" header with a normal request.
+		async := strings.Contains(
+			strings.ToLower(request.Header.Get("Prefer")),
+			"respond-async",
+		)
+		var job *reportJob
+		if path[0] == "jobs" {
+			if request.Method == "POST" && len(path) > 1 {
+				// POST /jobs/{report path} starts a job
+				path = path[1:]
+				async = true
+			} else if request.Method == "GET" &&
+				(len(path) == 2 || len(path) == 3 && path[2] == "result") {
+				// GET /jobs/{id} or /jobs/{id}/result
+				job = getJob(path[1])
+				if job == nil {
+					response.Header().Set("Content-Type", "text/plain")
+					response.WriteHeader(404)
+					_, err := response.Write([]byte("No job with that ID exists\n"))
+					jgh.PanicOnErr(err)
+					return true
+				}
+			} else {
+				response.Header().Set("Content-Type", "text/plain")
+				response.WriteHeader(404)
+				_, err := response.Write([]byte("Use POST /jobs/{report path}, " +
+					"GET /jobs/{id}, or GET /jobs/{id}/result\n"))
+				jgh.PanicOnErr(err)
+				return true
+			}
+		}
+
+		// an environment can be picked with a header instead of putting it
+		// in the path
+		envHeader := request.Header.Get("X-Cognos-Environment")
+		if envHeader != "" && job == nil {
+			config.mutex.Lock()
+			_, exists := getEnvironment(envHeader)
+			pathEnv, _ := splitEnvironment(path)
+			config.mutex.Unlock()
+			if !exists || pathEnv != "" && pathEnv != envHeader {
+				response.Header().Set("Content-Type", "text/plain")
+				response.WriteHeader(400)
+				_, err := response.Write([]byte("Unknown or conflicting " +
+					"X-Cognos-Environment\n"))
+				jgh.PanicOnErr(err)
+				return true
+			}
+			if pathEnv == "" {
+				path = append([]string{envHeader}, path...)
+			}
+		}
+
+		// access to a job is controlled by the report it runs
+		var jobResult bool
+		if job != nil {
+			jobResult = len(path) == 3
+			path = job.Path
+		}
+		access.Path = pathToString(path)
+
 		// check if the password is valid
-		if !AllowedAccess(password, path) {
+		var allowed bool
+		var usedKey, newPassword string
+		var restrictions keyRestrictions
+		if bearerToken != "" {
+			var err error
+			allowed, usedKey, err = jwtAllowedAccess(bearerToken, path)
+			if err != nil {
+				response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				response.Header().Set("Content-Type", "text/plain")
+				response.WriteHeader(401)
+				_, err := response.Write([]byte("Unauthorised: The bearer token " +
+					"is not valid: " + err.Error() + "\n"))
+				jgh.PanicOnErr(err)
+				return true
+			}
+		} else {
+			allowed, usedKey, newPassword, restrictions = AllowedAccess(
+				password,
+				path,
+				access.ClientIP,
+			)
+		}
+		if !allowed {
 			response.Header().Set("WWW-Authenticate", `Basic realm="Carl Sagan"`)
 			response.Header().Set("Content-Type", "text/plain")
 			response.WriteHeader(401)
@@ -133,38 +290,87 @@ func handlerFunc(response http.ResponseWriter, request *http.Request) {
 			jgh.PanicOnErr(err)
 			return true
 		}
+		if !runningAsCGI {
+			log.Println("Authenticated", appName, "with", usedKey)
+		}
+		access.Key = usedKey
+		// a password can be limited to some web pages
+		origin := request.Header.Get("Origin")
+		if origin != "" && len(restrictions.Origins) > 0 &&
+			!originAllowed(origin, restrictions.Origins) {
+			panic("403 Forbidden: This report password can't be used from " + origin)
+		}
+		// the master password was used on this report for the first time,
+		// so let the client know what the new report password is
+		if newPassword != "" {
+			response.Header().Set("X-Report-Password", newPassword)
+		}
 
-		// prompt answers can come in 4 ways (see function comment)
-		promptAnswers := getFormValues(request)
-
-		// determine the max age allowed by the request headers.
-		ccHeader := strings.ToLower(request.Header.Get("Cache-Control"))
-		var maxAge uint
-		if ccHeader == "" {
-			// default to value from config.
-			config.mutex.Lock()
-			maxAge = config.MaxAge
-			config.mutex.Unlock()
-		} else if ccHeader == "no-cache" {
-			maxAge = 0
-		} else if ccHeader == "only-if-cached" {
-			maxAge = math.MaxInt32
-		} else if strings.HasPrefix(ccHeader, "max-age=") {
-			maxAgeStr := strings.TrimPrefix(ccHeader, "max-age=")
-			maxAgeStr = strings.TrimSpace(maxAgeStr)
-			maxAge64, err := strconv.ParseInt(maxAgeStr, 10, 32)
-			if err != nil || maxAge64 < 0 {
+		if job != nil {
+			// a job's prompt answers have to be allowed by this password
+			// too, or it could read results made with another password
+			access.PromptAnswers = hashPromptAnswers(job.PromptAnswers)
+			checkPinnedPrompts(restrictions.Prompts, job.PromptAnswers)
+			if !jobResult {
+				writeJobStatus(response, 200, *job)
+				return true
+			}
+			if job.Status != jobDone {
 				response.Header().Set("Content-Type", "text/plain")
-				response.WriteHeader(400)
-				_, err := response.Write([]byte("The server did not understand your max-age header\n"))
+				response.WriteHeader(409)
+				_, err := response.Write([]byte("This job is " + job.Status + "\n"))
 				jgh.PanicOnErr(err)
 				return true
 			}
-			maxAge = uint(maxAge64)
-		} else {
+			reportCSV, generated, age := getFromCache(job.Hash)
+			if age == -1 {
+				response.Header().Set("Content-Type", "text/plain")
+				response.WriteHeader(410)
+				_, err := response.Write([]byte("The result of this job has " +
+					"been removed from the cache\n"))
+				jgh.PanicOnErr(err)
+				return true
+			}
+			reportCSV = redactColumns(reportCSV, restrictions)
+			access.Rows = countRows(reportCSV)
+			access.CacheStatus = cacheHit
+			writeReport(
+				response,
+				request,
+				asJSON || job.AsJSON,
+				path,
+				reportCSV,
+				generated,
+				cacheHit,
+			)
+			return true
+		}
+
+		// prompt answers can come in 4 ways (see function comment)
+		promptAnswers := getFormValues(request)
+		// log what was asked for even if it isn't allowed, then what we
+		// actually run
+		access.PromptAnswers = hashPromptAnswers(promptAnswers)
+		applyPinnedPrompts(restrictions.Prompts, promptAnswers)
+		access.PromptAnswers = hashPromptAnswers(promptAnswers)
+
+		// determine how we are allowed to use the cache
+		config.mutex.Lock()
+		envName, _ := splitEnvironment(path)
+		env, _ := getEnvironment(envName)
+		freshFor := env.MaxAge
+		staleWhileRevalidate := config.StaleWhileRevalidate
+		config.mutex.Unlock()
+		cacheOpts, err := parseCacheControl(
+			request.Header.Get("Cache-Control"),
+			freshFor,
+			staleWhileRevalidate,
+		)
+		if err != nil {
 			response.Header().Set("Content-Type", "text/plain")
-			response.WriteHeader(501)
-			_, err := response.Write([]byte("Requested Cache-Control method not implimented\n"))
+			response.WriteHeader(400)
+			_, err := response.Write([]byte("The server did not understand " +
+				"your Cache-Control header: " + err.Error() + "\n"))
 			jgh.PanicOnErr(err)
 			return true
 		}
@@ -173,38 +379,211 @@ func handlerFunc(response http.ResponseWriter, request *http.Request) {
 		// the cache is warmed
 		recordUse(path, promptAnswers)
 
-		// do the cognos requests
-		respBody := PrepareResponse(asJSON, path, promptAnswers, maxAge)
+		if async {
+			job := createJob(asJSON, path, promptAnswers, cacheOpts.MaxAge)
+			startJob(job.ID)
+			config.mutex.Lock()
+			jobURL := config.URLPrefix + "/jobs/" + job.ID
+			config.mutex.Unlock()
+			response.Header().Set("Location", jobURL)
+			response.Header().Set("Preference-Applied", "respond-async")
+			writeJobStatus(response, 202, job)
+			return true
+		}
 
-		// set the content type
-		if asJSON {
-			response.Header().Set("Content-Type", "application/json")
-		} else {
-			response.Header().Set("Content-Type", "text/csv")
-			// for CSV we specify a filename so I can give links to users for use in a browser.
-			// only allow charicters in the filename that I won't have to quote in the HTTP header
-			safeReportName := regexp.MustCompile("[^A-Za-z0-9 _.-]").ReplaceAllString((path[lastPathPos]), "")
-			response.Header().Set("Content-Disposition", `attachment; filename="`+safeReportName+`.csv"`)
-		}
-		// set content length
-		// this is not required, but lets browsers display progress
-		contentLength := strconv.FormatInt(int64(len([]byte(respBody))), 10)
-		response.Header().Set("Content-Length", contentLength)
-		// send actual data
-		_, err := response.Write([]byte(respBody))
-		jgh.PanicOnErr(err)
+		// do the cognos requests
+		// PrepareResponse modifies path, so give it a copy
+		reportCSV, generated, cacheStatus := PrepareResponse(
+			append([]string(nil), path...),
+			promptAnswers,
+			cacheOpts,
+		)
+		reportCSV = redactColumns(reportCSV, restrictions)
+		access.Rows = countRows(reportCSV)
+		access.CacheStatus = cacheStatus
+		writeReport(
+			response,
+			request,
+			asJSON,
+			path,
+			reportCSV,
+			generated,
+			cacheStatus,
+		)
 		return true
 	})
 	if !success {
-		response.Header().Set("Content-Type", "text/plain")
-		response.WriteHeader(500)
 		errRespBody := fmt.Sprintf("%v\n", errorMessage)
+		// errors may start with the HTTP status code we should send
+		status := jgh.Status(errRespBody)
+		if status < 400 || status > 599 {
+			status = 500
+		}
+		response.Header().Set("Content-Type", "text/plain")
+		response.WriteHeader(status)
 		_, err := response.Write([]byte(errRespBody))
 		jgh.PanicOnErr(err)
 	}
+
+	if access != nil {
+		access.Status = recorder.status
+		recordAccess(*access)
+	}
+
+	// the response isn't sent until we return, so waiting here slows down
+	// password guessing without holding any locks
+	if loginSubjects != nil && recorder.status == 401 {
+		time.Sleep(recordAuthFailure(loginSubjects))
+	}
 }
 
-func loadConfigFixedLocation() {
+// the ETag for a report is based on a hash of the CSV data. JSON is
+// generated from CSV, so we just need to tell them apart. Compressed
+// responses also need their own ETag.
+func reportETag(asJSON bool, encoding string, reportCSV string) string {
+	hash := sha256.Sum256([]byte(reportCSV))
+	etag := hex.EncodeToString(hash[:16])
+	if asJSON {
+		etag += "-json"
+	}
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	return `"` + etag + `"`
+}
+
+// check If-None-Match and If-Modified-Since to see if the client already
+// has the current version of a report
+func notModified(request *http.Request, etag string, generated time.Time) bool {
+	// conditional requests only make sense if we are just fetching data
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return false
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	ifNoneMatch := request.Header.Get("If-None-Match")
+	if ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			// weak comparison is fine for GET
+			candidate = strings.TrimPrefix(candidate, "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince := request.Header.Get("If-Modified-Since")
+	if ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		// an invalid date is ignored
+		if err != nil {
+			return false
+		}
+		// HTTP dates only have 1 second resolution
+		return !generated.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// send report data as either CSV or JSON. generated is when the data was
+// pulled from Cognos. cacheStatus is where the data came from.
+func writeReport(
+	response http.ResponseWriter,
+	request *http.Request,
+	asJSON bool,
+	path []string,
+	reportCSV string,
+	generated time.Time,
+	cacheStatus string,
+) {
+	var respBody string
+	if asJSON {
+		respBody = csvToJSON(reportCSV)
+	} else {
+		respBody = reportCSV
+	}
+
+	// pick a content coding (if the response is big enough to bother)
+	var encoding string
+	if len(respBody) >= minCompressSize {
+		encoding = negotiateEncoding(request.Header.Get("Accept-Encoding"))
+	}
+	response.Header().Add("Vary", "Accept-Encoding")
+
+	// headers that describe the cache entry. These are sent even if we
+	// don't send the body
+	etag := reportETag(asJSON, encoding, reportCSV)
+	response.Header().Set("ETag", etag)
+	response.Header().Set("Last-Modified", generated.UTC().Format(http.TimeFormat))
+	age := int64(time.Now().Sub(generated) / time.Second)
+	if age < 0 {
+		age = 0
+	}
+	response.Header().Set("Age", strconv.FormatInt(age, 10))
+	if cacheStatus == cacheMiss {
+		response.Header().Set("X-Cache", "MISS")
+	} else {
+		response.Header().Set("X-Cache", "HIT")
+		// let the client know if we served something past it's freshness
+		// lifetime (max-stale, stale-if-error, etc.)
+		config.mutex.Lock()
+		envName, _ := splitEnvironment(path)
+		env, _ := getEnvironment(envName)
+		freshFor := env.MaxAge
+		config.mutex.Unlock()
+		if cacheStatus == cacheStale {
+			response.Header().Set("Warning", `111 - "Revalidation Failed"`)
+			response.Header().Set("X-Stale", "true")
+		} else if age > int64(freshFor) {
+			response.Header().Set("Warning", `110 - "Response is Stale"`)
+			response.Header().Set("X-Stale", "true")
+		}
+	}
+
+	if notModified(request, etag, generated) {
+		response.WriteHeader(304)
+		return
+	}
+
+	// set the content type
+	if asJSON {
+		response.Header().Set("Content-Type", "application/json")
+	} else {
+		response.Header().Set("Content-Type", "text/csv")
+		// for CSV we specify a filename so I can give links to users for use in a browser.
+		// only allow charicters in the filename that I won't have to quote in the HTTP header
+		safeReportName := regexp.MustCompile("[^A-Za-z0-9 _.-]").ReplaceAllString((path[len(path)-1]), "")
+		response.Header().Set("Content-Disposition", `attachment; filename="`+safeReportName+`.csv"`)
+	}
+	respBytes := []byte(respBody)
+	if encoding != "" {
+		respBytes = compressBody(encoding, respBytes)
+		response.Header().Set("Content-Encoding", encoding)
+	}
+	// set content length
+	// this is not required, but lets browsers display progress
+	contentLength := strconv.FormatInt(int64(len(respBytes)), 10)
+	response.Header().Set("Content-Length", contentLength)
+	// send actual data
+	_, err := response.Write(respBytes)
+	jgh.PanicOnErr(err)
+}
+
+// send the status of a job as JSON
+func writeJobStatus(response http.ResponseWriter, status int, job reportJob) {
+	jobJSON, err := json.MarshalIndent(job, "", "\t")
+	jgh.PanicOnErr(err)
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	_, err = response.Write(jobJSON)
+	jgh.PanicOnErr(err)
+}
+
+// config.json is always in the same folder as this executable
+func configFixedLocation() string {
 	// get the directory of this executable
 	exePath, err := os.Executable()
 	jgh.PanicOnErr(err)
@@ -213,7 +592,11 @@ func loadConfigFixedLocation() {
 	configPath := filepath.Join(exeFolder, "config.json")
 
 	// IDK what this is, but it happens in IIS
-	configPath = strings.TrimPrefix(configPath, `\\?\`)
+	return strings.TrimPrefix(configPath, `\\?\`)
+}
+
+func loadConfigFixedLocation() {
+	configPath := configFixedLocation()
 
 	config.mutex.Lock()
 	defer config.mutex.Unlock()
@@ -231,14 +614,30 @@ func main() {
 		// use built-in webserver
 		// load config
 		loadConfigFixedLocation()
+		watchConfig()
 
 		// print a warning about no encryption
 		fmt.Println("WARNING: You are using the standalone webserver. It does not support TLS.")
 
 		// start the webserver
-		http.HandleFunc("/", handlerFunc)
-		port := os.Args[2]
-		err := http.ListenAndServe(port, nil)
+		listener := listen(os.Args[2])
+		err := http.Serve(listener, http.HandlerFunc(serverHandlerFunc))
+		jgh.PanicOnErr(err)
+	} else if len(os.Args) >= 2 && len(os.Args) <= 3 && os.Args[1] == "--fastcgi" {
+		// load config once. Unlike CGI, we stay running between requests.
+		loadConfigFixedLocation()
+		watchConfig()
+
+		// with no address, the web server gives us a socket as stdin.
+		// IIS gives us a named pipe instead, which we can't use.
+		var listener net.Listener
+		if len(os.Args) == 3 {
+			listener = listen(os.Args[2])
+		} else if runtime.GOOS == "windows" {
+			panic("--fastcgi needs an address on Windows. IIS should " +
+				"proxy to --fastcgi <address> or --standalone <address>.")
+		}
+		err := fcgi.Serve(listener, http.HandlerFunc(serverHandlerFunc))
 		jgh.PanicOnErr(err)
 	} else if len(os.Args) == 3 && os.Args[1] == "--warm" {
 		// load config
@@ -248,6 +647,108 @@ func main() {
 		usedWithin, err := strconv.ParseUint(os.Args[2], 10, 32)
 		jgh.PanicOnErr(err)
 		warmCache(uint(usedWithin))
+	} else if len(os.Args) == 3 && os.Args[1] == "--job" {
+		// run an asynchronous job. This is how jobs are started when
+		// we are running as CGI
+		loadConfigFixedLocation()
+		runJob(os.Args[2])
+	} else if len(os.Args) == 2 && os.Args[1] == "--hash-password" {
+		// read the password from stdin so it doesn't end up in the shell
+		// history or the process list
+		fmt.Fprintln(os.Stderr, "Enter a master password:")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		fmt.Println(hashMasterPassword(password))
+	} else if len(os.Args) >= 3 && len(os.Args) <= 4 && os.Args[1] == "--set-credential" {
+		// add or change a Cognos password in config.json. The password
+		// is encrypted (see credentials.go).
+		username := os.Args[2]
+		var envName string
+		if len(os.Args) == 4 {
+			envName = os.Args[3]
+		}
+		fmt.Fprintln(os.Stderr, "Enter the Cognos password for", username+":")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		found := false
+		editCredentials(configFixedLocation(), func(
+			key []byte,
+			env string,
+			passwords map[string]string,
+		) bool {
+			if env != envName {
+				return false
+			}
+			passwords[username] = encryptCredential(key, password)
+			found = true
+			return true
+		})
+		if !found {
+			fmt.Fprintln(os.Stderr, "There is no environment named", envName)
+			os.Exit(1)
+		}
+		// if the old password stopped working, the new one should be
+		// tried right away
+		clearCredentialFailures(envName, username)
+	} else if len(os.Args) == 2 && os.Args[1] == "--encrypt-credentials" {
+		// encrypt any Cognos passwords in config.json that aren't already
+		editCredentials(configFixedLocation(), func(
+			key []byte,
+			env string,
+			passwords map[string]string,
+		) (changed bool) {
+			for username, password := range passwords {
+				if !strings.HasPrefix(password, encryptedCredentialPrefix) {
+					passwords[username] = encryptCredential(key, password)
+					changed = true
+				}
+			}
+			return
+		})
+	} else if len(os.Args) >= 2 && os.Args[1] == "--audit" {
+		// search the audit log. Filters are given as name=value.
+		loadConfigFixedLocation()
+		filters := make(map[string]string)
+		for _, arg := range os.Args[2:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				fmt.Fprintln(os.Stderr, "Filters must look like name=value:", arg)
+				os.Exit(1)
+			}
+			filters[parts[0]] = parts[1]
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(writer, "TIME\tSTATUS\tKEY\tAPP\tIP\tPATH\tROWS\tCACHE")
+		for _, entry := range searchAuditLog(filters) {
+			fmt.Fprintf(
+				writer,
+				"%s\t%d\t%s\t%s\t%s\t%s\t%d\t%s\n",
+				entry.Time.Format(time.RFC3339),
+				entry.Status,
+				entry.Key,
+				entry.AppName,
+				entry.ClientIP,
+				entry.Path,
+				entry.Rows,
+				entry.CacheStatus,
+			)
+		}
+		writer.Flush()
+	} else if len(os.Args) >= 2 && len(os.Args) <= 3 && os.Args[1] == "--clean-keys" {
+		// list (or with --delete, remove) report passwords for reports
+		// that no longer exist
+		loadConfigFixedLocation()
+		if len(os.Args) == 3 && os.Args[2] != "--delete" {
+			fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "--clean-keys [--delete]")
+			os.Exit(1)
+		}
+		cleanReportPasswords(len(os.Args) == 3)
 	} else if len(os.Args) == 1 {
 		// cgi
 		runningAsCGI = true
@@ -255,10 +756,18 @@ func main() {
 			success, errorMessage := jgh.Try(0, 1, false, "", func() bool {
 				// trim the path to the CGI off our request path
 				cgiPrefix := os.Getenv("SCRIPT_NAME")
+				trimmed := strings.HasPrefix(request.URL.Path, cgiPrefix)
 				request.URL.Path = strings.TrimPrefix(request.URL.Path, cgiPrefix)
 
 				// load the global config
 				loadConfigFixedLocation()
+
+				// we need this to build links back to ourself
+				if trimmed {
+					config.mutex.Lock()
+					config.URLPrefix = cgiPrefix
+					config.mutex.Unlock()
+				}
 				return true
 			})
 			if !success {
@@ -275,11 +784,20 @@ func main() {
 		jgh.PanicOnErr(err)
 	} else {
 		// invalid args; print usage information
-		fmt.Println("Usage:", os.Args[0], "--standalone [ip address]:<port>")
+		fmt.Println("Usage:", os.Args[0], "--standalone <address>")
+		fmt.Println("      ", os.Args[0], "--fastcgi [address]")
 		fmt.Println("      ", os.Args[0], "--warm <used within seconds>")
+		fmt.Println("      ", os.Args[0], "--hash-password")
+		fmt.Println("      ", os.Args[0], "--clean-keys [--delete]")
+		fmt.Println("      ", os.Args[0], "--set-credential <Cognos username> [environment]")
+		fmt.Println("      ", os.Args[0], "--encrypt-credentials")
+		fmt.Println("      ", os.Args[0], "--audit [key=...] [app=...] [ip=...] [path=...] [answer=...]")
+		fmt.Println("       [since=...] [until=...] [denied=true] [limit=...]")
+		fmt.Println("An address can be [ip address]:<port>, unix:<socket path>, or systemd")
 		fmt.Println("Examples:", os.Args[0], "--standalone :8080")
 		fmt.Println("         ", os.Args[0], "--standalone 127.0.0.1:8080")
-		fmt.Println("This executable also supports CGI.")
+		fmt.Println("         ", os.Args[0], "--fastcgi unix:/run/carlsagan/carlsagan.sock")
+		fmt.Println("This executable also supports CGI, and FastCGI on stdin.")
 		fmt.Println()
 		fmt.Println("Put a file named config.json in the same directory as the executable.")
 		fmt.Println("For information on what should go in this file, see the documentation.")
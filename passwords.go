@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/9072997/jgh"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// report passwords are 64 random characters, so a salted SHA-256 is plenty
+// and it is fast enough to check on every request. The master password is
+// picked by a person, so it gets bcrypt.
+const reportPasswordHashPrefix = "sha256$"
+
+// hash a report password as sha256${salt}${hash}
+func hashReportPassword(password string) string {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	jgh.PanicOnErr(err)
+	return reportPasswordHashPrefix +
+		hex.EncodeToString(salt) + "$" +
+		saltedHash(salt, password)
+}
+
+func saltedHash(salt []byte, password string) string {
+	hash := sha256.Sum256(append(append([]byte(nil), salt...), password...))
+	return hex.EncodeToString(hash[:])
+}
+
+// check a password against a hash from hashReportPassword in constant time
+func checkReportPassword(hashedPassword, providedPassword string) bool {
+	parts := strings.Split(
+		strings.TrimPrefix(hashedPassword, reportPasswordHashPrefix),
+		"$",
+	)
+	if !strings.HasPrefix(hashedPassword, reportPasswordHashPrefix) ||
+		len(parts) != 2 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	providedHash := saltedHash(salt, providedPassword)
+	return subtle.ConstantTimeCompare([]byte(providedHash), []byte(parts[1])) == 1
+}
+
+// the master password in config.json may be a bcrypt hash (see
+// --hash-password) or plaintext. An empty master password means there is
+// no master password.
+func checkMasterPassword(masterPassword, providedPassword string) bool {
+	if masterPassword == "" {
+		return false
+	}
+	if _, err := bcrypt.Cost([]byte(masterPassword)); err == nil {
+		err := bcrypt.CompareHashAndPassword(
+			[]byte(masterPassword),
+			[]byte(providedPassword),
+		)
+		return err == nil
+	}
+
+	// hash both so the comparison doesn't leak the length
+	masterHash := sha256.Sum256([]byte(masterPassword))
+	providedHash := sha256.Sum256([]byte(providedPassword))
+	return subtle.ConstantTimeCompare(masterHash[:], providedHash[:]) == 1
+}
+
+// used by --hash-password to make a hash an operator can put in
+// config.json as the master password
+func hashMasterPassword(password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	jgh.PanicOnErr(err)
+	return string(hash)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/9072997/jgh"
+	"github.com/iancoleman/strcase"
+)
+
+// how a column can be redacted for a report password
+const (
+	// the column is removed
+	redactDrop = "drop"
+	// letters and numbers are replaced with "*" (ex: ***-**-****)
+	redactMask = "mask"
+	// the value is replaced with an HMAC of it, so rows can still be
+	// matched up without knowing the real value
+	redactPseudonymize = "pseudonymize"
+)
+
+// apply a password's column rules to report data. This is done after the
+// cache, so one run of a report can be shared by passwords with different
+// rules. Columns are matched by their name in the header row (see
+// columnKey).
+func redactColumns(reportCSV string, restrictions keyRestrictions) string {
+	if len(restrictions.Columns) == 0 {
+		return reportCSV
+	}
+
+	csvReader := csv.NewReader(strings.NewReader(reportCSV))
+	data, err := csvReader.ReadAll()
+	jgh.PanicOnErr(err)
+	if len(data) == 0 {
+		return reportCSV
+	}
+
+	// rules can use the CSV name or the JSON name of a column, in any case
+	ruleFor := make(map[string]string)
+	for name, rule := range restrictions.Columns {
+		ruleFor[columnKey(name)] = rule
+	}
+	rules := make([]string, len(data[0]))
+	matched := make(map[string]bool)
+	for i, name := range data[0] {
+		rules[i] = ruleFor[columnKey(name)]
+		matched[columnKey(name)] = true
+	}
+	// a rule for a column that isn't there may be a typo, which would let
+	// the real column through
+	for name := range restrictions.Columns {
+		if !matched[columnKey(name)] {
+			log.Println("Column rule for", name, "does not match any column in the report")
+		}
+	}
+
+	var out strings.Builder
+	csvWriter := csv.NewWriter(&out)
+	for rowNum, row := range data {
+		var newRow []string
+		for i, value := range row {
+			// the header row only has columns dropped
+			if rowNum > 0 && i < len(rules) {
+				switch rules[i] {
+				case redactMask:
+					value = maskValue(value)
+				case redactPseudonymize:
+					value = pseudonymize(restrictions.PseudonymKey, value)
+				}
+			}
+			if i < len(rules) && rules[i] == redactDrop {
+				continue
+			}
+			newRow = append(newRow, value)
+		}
+		err := csvWriter.Write(newRow)
+		jgh.PanicOnErr(err)
+	}
+	csvWriter.Flush()
+	jgh.PanicOnErr(csvWriter.Error())
+	return out.String()
+}
+
+// a column name in the form used to match column rules. This is the name
+// csvToJSON would use, ignoring case.
+func columnKey(name string) string {
+	return strings.ToLower(strcase.ToLowerCamel(strings.TrimSpace(name)))
+}
+
+// replace letters and numbers with "*", keeping punctuation so the format
+// of the value is still visible
+func maskValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return '*'
+		}
+		return r
+	}, value)
+}
+
+// a keyed HMAC of a value. The same value always gives the same pseudonym
+// for a given key. Empty values stay empty.
+func pseudonymize(key string, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/9072997/jgh"
+)
+
+// how often we check if config.json has changed
+const configPollInterval = 2 * time.Second
+
+// reload config.json if it changes or if we get a SIGHUP. This is only
+// useful for the servers that stay running. CGI reads the config for every
+// request anyway.
+func watchConfig() {
+	config.mutex.Lock()
+	configPath := config.configPath
+	config.mutex.Unlock()
+
+	// SIGHUP is never sent on Windows, but asking for it is harmless
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		lastModified, lastSize := configFileVersion(configPath)
+		ticker := time.NewTicker(configPollInterval)
+		for {
+			select {
+			case <-hangup:
+				log.Println("Got SIGHUP, reloading config")
+			case <-ticker.C:
+				modified, size := configFileVersion(configPath)
+				if modified.Equal(lastModified) && size == lastSize {
+					continue
+				}
+				lastModified, lastSize = modified, size
+				log.Println("config.json changed, reloading config")
+			}
+			reloadConfig(configPath)
+		}
+	}()
+}
+
+// used to tell if a file has changed. Errors are treated as an empty file.
+func configFileVersion(configPath string) (modified time.Time, size int64) {
+	fileInfo, err := os.Stat(configPath)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return fileInfo.ModTime(), fileInfo.Size()
+}
+
+// swap in a new config. If the new config is invalid, we keep the old one.
+// Requests that are already running keep using the settings they started
+// with.
+func reloadConfig(configPath string) {
+	success, errorMessage := jgh.Try(0, 1, false, "", func() bool {
+		newConfig := parseConfigFile(configPath)
+
+		config.mutex.Lock()
+		config.configFile = newConfig
+		config.mutex.Unlock()
+		return true
+	})
+	if !success {
+		log.Println("Keeping the old config because the new one is invalid:", errorMessage)
+	}
+}